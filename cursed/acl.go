@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type aclRule struct {
+	Name            string
+	Effect          string
+	Users           []string
+	Groups          []string
+	Principals      []string
+	Extensions      []string
+	ForceCommand    string
+	MaxDuration     int
+	SourceAddresses []string
+
+	exts     map[string]string
+	srcNets  []*net.IPNet
+	maxDur   time.Duration
+	hasExts  bool
+	wildUser bool
+}
+
+type aclPolicy struct {
+	rules []*aclRule
+}
+
+func loadACLPolicy(path string) (*aclPolicy, error) {
+	// Read the policy file with its own viper instance to keep it out of the main config
+	v := viper.New()
+	v.SetConfigFile(path)
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %v", err)
+	}
+
+	var rules []*aclRule
+	err = v.UnmarshalKey("rules", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy file: %v", err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("policy file contains no rules: %s", path)
+	}
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		err = rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %q: %v", rule.Name, err)
+		}
+	}
+
+	return &aclPolicy{rules: rules}, nil
+}
+
+func (rule *aclRule) validate() error {
+	rule.Effect = strings.ToLower(rule.Effect)
+	if rule.Effect != "allow" && rule.Effect != "deny" {
+		return fmt.Errorf("effect must be allow or deny: %s", rule.Effect)
+	}
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return fmt.Errorf("at least one user or group is required")
+	}
+	if len(rule.Principals) == 0 {
+		return fmt.Errorf("at least one principal is required")
+	}
+	for _, u := range rule.Users {
+		if u == "*" {
+			rule.wildUser = true
+		}
+	}
+
+	// Extensions limit what certificates issued under this rule may be granted
+	if rule.Extensions != nil {
+		var errSlice []error
+		rule.exts, errSlice = validateExtensions(rule.Extensions)
+		if len(errSlice) > 0 {
+			return errSlice[0]
+		}
+		rule.hasExts = true
+	}
+
+	// Source addresses may be single IPs or CIDR ranges
+	for _, addr := range rule.SourceAddresses {
+		if !strings.Contains(addr, "/") {
+			if strings.Contains(addr, ":") {
+				addr += "/128"
+			} else {
+				addr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return fmt.Errorf("invalid source address: %v", err)
+		}
+		rule.srcNets = append(rule.srcNets, ipNet)
+	}
+
+	if rule.MaxDuration < 0 {
+		return fmt.Errorf("maxduration must not be negative: %d", rule.MaxDuration)
+	}
+	rule.maxDur = time.Duration(rule.MaxDuration) * time.Second
+
+	return nil
+}
+
+func (pol *aclPolicy) match(conf *config, user, principal string) (*aclRule, error) {
+	// Rules are evaluated in order, and the first rule matching both user and principal wins
+	for _, rule := range pol.rules {
+		if !rule.hasPrincipal(principal) {
+			continue
+		}
+
+		ok, err := rule.hasUser(conf, user)
+		if err == errExecBusy {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not check groups for policy rule %q (user: %s): %v", rule.Name, user, err)
+		}
+		if !ok {
+			continue
+		}
+
+		if rule.Effect == "deny" {
+			return nil, fmt.Errorf("denied by policy rule %q (user: %s, principal: %s)", rule.Name, user, principal)
+		}
+
+		return rule, nil
+	}
+
+	return nil, fmt.Errorf("no policy rule permits user %s as principal %s", user, principal)
+}
+
+func (rule *aclRule) hasPrincipal(principal string) bool {
+	for _, p := range rule.Principals {
+		if p == "*" || p == principal {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule *aclRule) hasUser(conf *config, user string) (bool, error) {
+	if rule.wildUser {
+		return true, nil
+	}
+	for _, u := range rule.Users {
+		if u == user {
+			return true, nil
+		}
+	}
+
+	// Group membership is checked by our group authorizer. If it can't answer we don't know
+	// whether a deny rule applies, so the caller has to reject the request
+	if len(rule.Groups) > 0 {
+		err := checkGroups(conf, user, rule.Groups)
+		if _, ok := err.(*notMemberError); ok {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (rule *aclRule) apply(cc *certConfig) error {
+	// Drop any extensions the rule doesn't allow
+	if rule.hasExts {
+		exts := make(map[string]string)
+		for name, val := range cc.extensions {
+			if _, ok := rule.exts[name]; ok {
+				exts[name] = val
+			}
+		}
+		cc.extensions = exts
+	}
+	if rule.ForceCommand != "" {
+		cc.command = rule.ForceCommand
+	}
+
+	// Clamp the certificate lifetime to the rule's maximum
+	if rule.maxDur > 0 {
+		maxVB := time.Now().Add(rule.maxDur)
+		if cc.validBefore.After(maxVB) {
+			cc.validBefore = maxVB
+		}
+	}
+
+	// The bastion must be within the rule's permitted source addresses
+	if len(rule.srcNets) > 0 {
+		ip := net.ParseIP(cc.srcAddr)
+		if ip == nil {
+			return fmt.Errorf("policy rule %q requires a valid source address", rule.Name)
+		}
+		permitted := false
+		for _, n := range rule.srcNets {
+			if n.Contains(ip) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return fmt.Errorf("source address %s not permitted by policy rule %q", cc.srcAddr, rule.Name)
+		}
+	}
+
+	return nil
+}
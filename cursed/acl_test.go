@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Answers group checks from a fixed membership list, or fails every lookup when down is set
+type testAuthorizer struct {
+	down    bool
+	members map[string][]string
+}
+
+func (a testAuthorizer) checkGroups(conf *config, user string, groups []string) error {
+	if a.down {
+		return errors.New("directory unreachable")
+	}
+	for _, g := range groups {
+		for _, m := range a.members[g] {
+			if m == user {
+				return nil
+			}
+		}
+	}
+
+	return &notMemberError{errors.New("not a member")}
+}
+
+const testPolicy = `
+rules:
+  - name: no-root-for-contractors
+    effect: deny
+    groups: [contractors]
+    principals: [root]
+  - name: ops-root
+    effect: allow
+    groups: [ops]
+    principals: [root]
+    maxduration: 600
+  - name: alice-anything
+    effect: allow
+    users: [alice]
+    principals: ["*"]
+  - name: web
+    effect: allow
+    users: ["*"]
+    principals: [www]
+    extensions: [permit-pty]
+    forcecommand: /usr/bin/deploy
+    sourceaddresses: [10.0.0.0/8, 192.168.1.1]
+`
+
+func writeTestPolicy(t *testing.T, policy string) *aclPolicy {
+	t.Helper()
+
+	path := filepath.Join(testTempDir(t), "policy.yaml")
+	err := ioutil.WriteFile(path, []byte(policy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pol, err := loadACLPolicy(path)
+	if err != nil {
+		t.Fatalf("loadACLPolicy: %v", err)
+	}
+
+	return pol
+}
+
+func TestACLMatch(t *testing.T) {
+	pol := writeTestPolicy(t, testPolicy)
+	conf := &config{authorizer: testAuthorizer{members: map[string][]string{
+		"contractors": {"mallory"},
+		"ops":         {"bob", "mallory"},
+	}}}
+
+	tests := []struct {
+		user, principal string
+		rule            string
+		err             string
+	}{
+		{user: "bob", principal: "root", rule: "ops-root"},
+		{user: "mallory", principal: "root", err: `denied by policy rule "no-root-for-contractors"`},
+		{user: "alice", principal: "root", rule: "alice-anything"},
+		{user: "alice", principal: "www", rule: "alice-anything"},
+		{user: "carol", principal: "www", rule: "web"},
+		{user: "carol", principal: "root", err: "no policy rule permits user carol as principal root"},
+	}
+	for _, tt := range tests {
+		rule, err := pol.match(conf, tt.user, tt.principal)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("match(%s, %s): got error %v, want %q", tt.user, tt.principal, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("match(%s, %s): unexpected error: %v", tt.user, tt.principal, err)
+			continue
+		}
+		if rule.Name != tt.rule {
+			t.Errorf("match(%s, %s): got rule %s, want %s", tt.user, tt.principal, rule.Name, tt.rule)
+		}
+	}
+}
+
+func TestACLMatchFailsClosed(t *testing.T) {
+	pol := writeTestPolicy(t, testPolicy)
+	conf := &config{authorizer: testAuthorizer{down: true}}
+
+	// The deny rule can't be evaluated, so we must not fall through to the allow rules
+	_, err := pol.match(conf, "alice", "root")
+	if err == nil || !strings.Contains(err.Error(), "could not check groups") {
+		t.Fatalf("got %v, want a group lookup failure", err)
+	}
+
+	// Principals no group rule applies to still work
+	rule, err := pol.match(conf, "carol", "www")
+	if err != nil || rule.Name != "web" {
+		t.Fatalf("got rule %v, error %v, want web", rule, err)
+	}
+}
+
+func TestACLApply(t *testing.T) {
+	pol := writeTestPolicy(t, testPolicy)
+	conf := &config{authorizer: testAuthorizer{}}
+
+	rule, err := pol.match(conf, "carol", "www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &certConfig{
+		command:     "/bin/sh",
+		extensions:  map[string]string{"permit-pty": "", "permit-port-forwarding": ""},
+		srcAddr:     "10.1.2.3",
+		validBefore: time.Now().Add(time.Hour),
+	}
+	err = rule.apply(cc)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if _, ok := cc.extensions["permit-port-forwarding"]; ok || len(cc.extensions) != 1 {
+		t.Errorf("extensions not limited by rule: %v", cc.extensions)
+	}
+	if cc.command != "/usr/bin/deploy" {
+		t.Errorf("force command not applied: %s", cc.command)
+	}
+
+	cc.srcAddr = "172.16.0.1"
+	if rule.apply(cc) == nil {
+		t.Errorf("source address outside the rule's networks was allowed")
+	}
+	cc.srcAddr = "192.168.1.1"
+	if err = rule.apply(cc); err != nil {
+		t.Errorf("single source address not allowed: %v", err)
+	}
+
+	// Certificate lifetimes are clamped to the rule's maximum
+	rule, err = pol.match(&config{authorizer: testAuthorizer{members: map[string][]string{"ops": {"bob"}}}}, "bob", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc = &certConfig{validBefore: time.Now().Add(time.Hour)}
+	err = rule.apply(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(cc.validBefore) > 10*time.Minute {
+		t.Errorf("lifetime not clamped: %s", cc.validBefore)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	approvalApproved = "approved"
+	approvalDenied   = "denied"
+	approvalExpired  = "expired"
+	approvalPending  = "pending"
+)
+
+var (
+	errApprovalDecided  = errors.New("approval request has already been decided")
+	errApprovalNotFound = errors.New("no such approval request")
+	errApprovalSelf     = errors.New("approvers can't approve their own requests")
+)
+
+// Held while deciding on a request, so two approvers can't both sign the same request
+var approvalMu sync.Mutex
+
+type approvalRequest struct {
+	Approver       string       `json:"approver,omitempty"`
+	BastionIP      string       `json:"bastion_ip"`
+	Cert           string       `json:"cert,omitempty"`
+	Command        string       `json:"cmd,omitempty"`
+	Created        time.Time    `json:"created"`
+	Decided        *time.Time   `json:"decided,omitempty"`
+	Duration       int64        `json:"duration"`
+	Expires        time.Time    `json:"expires"`
+	Extensions     []string     `json:"extensions,omitempty"`
+	ID             string       `json:"id"`
+	Key            string       `json:"key"`
+	KeyID          keyIDContext `json:"key_id"`
+	Principal      string       `json:"principal"`
+	Reason         string       `json:"reason,omitempty"`
+	Requester      string       `json:"requester"`
+	Status         string       `json:"status"`
+	UserIP         string       `json:"user_ip,omitempty"`
+	VerifyRequired bool         `json:"verify_required,omitempty"`
+}
+
+func approvalRequired(conf *config, principal string) bool {
+	l, ok := conf.PrincipalLimits[strings.ToLower(principal)]
+	return ok && l.RequireApproval
+}
+
+func newApproval(conf *config, key string, cc *certConfig, kc keyIDContext) (*approvalRequest, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate approval request id: %v", err)
+	}
+
+	// The certificate is signed when the request is approved, so keep everything needed to sign it
+	now := time.Now().UTC()
+	ar := &approvalRequest{
+		ID:             hex.EncodeToString(b),
+		Status:         approvalPending,
+		Requester:      cc.requester,
+		Principal:      cc.principals[0],
+		Command:        cc.command,
+		Created:        now,
+		Expires:        now.Add(conf.approvalTimeout),
+		Key:            key,
+		Duration:       int64(time.Until(cc.validBefore).Round(time.Second) / time.Second),
+		BastionIP:      cc.srcAddr,
+		KeyID:          kc,
+		UserIP:         cc.userIP,
+		VerifyRequired: cc.verifyRequired,
+	}
+	for name := range cc.extensions {
+		ar.Extensions = append(ar.Extensions, name)
+	}
+
+	// Clear out old requests, which would otherwise keep their certificates forever
+	pruned, err := dbPruneApprovals(conf, time.Now())
+	if err != nil {
+		log.Printf("warning - %v", err)
+	} else if pruned > 0 {
+		log.Printf("pruned %d old approval requests", pruned)
+	}
+
+	err = dbPutApproval(conf, ar)
+	if err != nil {
+		return nil, err
+	}
+
+	return ar, nil
+}
+
+func (ar *approvalRequest) expire() bool {
+	if ar.Status == approvalPending && time.Now().After(ar.Expires) {
+		ar.Status = approvalExpired
+		return true
+	}
+
+	return false
+}
+
+func decideApproval(conf *config, id, approver string, approve bool, reason string) (*approvalRequest, error) {
+	approvalMu.Lock()
+	defer approvalMu.Unlock()
+
+	ar, err := dbGetApproval(conf, id)
+	if err != nil {
+		return nil, err
+	}
+	if ar == nil {
+		return nil, errApprovalNotFound
+	}
+	if ar.expire() {
+		dbPutApproval(conf, ar)
+	}
+	if ar.Status != approvalPending {
+		return nil, errApprovalDecided
+	}
+
+	// The whole point is a second person
+	if ar.Requester == approver {
+		return nil, errApprovalSelf
+	}
+
+	ar.Approver = approver
+	ar.Reason = reason
+	now := time.Now().UTC()
+	ar.Decided = &now
+	ar.Status = approvalDenied
+	if approve {
+		cert, err := ar.sign(conf)
+		if err != nil {
+			return nil, err
+		}
+		ar.Cert = string(cert)
+		ar.Status = approvalApproved
+	}
+
+	err = dbPutApproval(conf, ar)
+	if err != nil {
+		return nil, err
+	}
+
+	return ar, nil
+}
+
+func (ar *approvalRequest) sign(conf *config) ([]byte, error) {
+	// Issuance may have been locked down while the request was waiting. The request stays pending
+	// so it can still be approved once the lockdown is lifted
+	err := checkLockdown(conf, ar.Requester)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ar.Key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pubkey: %v", err)
+	}
+
+	// The pubkey may have been revoked while the request was waiting
+	revoked, err := pubKeyRevoked(conf, pk)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("pubkey %s has been revoked", ssh.FingerprintSHA256(pk))
+	}
+
+	// The certificate's validity starts from when it's approved
+	exts := make(map[string]string)
+	for _, name := range ar.Extensions {
+		exts[name] = ""
+	}
+	now := time.Now()
+	cc := certConfig{
+		certType:       ssh.UserCert,
+		command:        ar.Command,
+		extensions:     exts,
+		principals:     []string{ar.Principal},
+		requester:      ar.Requester,
+		srcAddr:        ar.BastionIP,
+		userIP:         ar.UserIP,
+		validAfter:     now.Add(-30 * time.Second),
+		validBefore:    now.Add(time.Duration(ar.Duration) * time.Second),
+		verifyRequired: ar.VerifyRequired,
+	}
+
+	kc := ar.KeyID
+	kc.CA = string(conf.sshCA.activeFP())
+	kc.ValidBefore = cc.validBefore.Truncate(time.Second)
+	cc.keyID, err = kc.format(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return signPubKey(conf, []byte(ar.Key), cc)
+}
+
+// certKeyID returns the key ID of the certificate signed for an approved request
+func (ar *approvalRequest) certKeyID() string {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ar.Cert))
+	if err != nil {
+		return ""
+	}
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		return cert.KeyId
+	}
+
+	return ""
+}
+
+func dbPutApproval(conf *config, ar *approvalRequest) error {
+	val, err := json.Marshal(ar)
+	if err != nil {
+		return fmt.Errorf("failed to encode approval request: %v", err)
+	}
+
+	err = dbUpdate(conf, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameApprovals)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(ar.ID), val)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save approval request in database: %v", err)
+	}
+
+	return nil
+}
+
+func dbGetApproval(conf *config, id string) (*approvalRequest, error) {
+	var ar *approvalRequest
+
+	err := dbView(conf, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conf.bucketNameApprovals)
+		if bucket == nil {
+			return nil
+		}
+
+		val := bucket.Get([]byte(id))
+		if val == nil {
+			return nil
+		}
+
+		ar = &approvalRequest{}
+		return json.Unmarshal(val, ar)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval request from database: %v", err)
+	}
+
+	return ar, nil
+}
+
+// dbPruneApprovals deletes requests that were decided or expired more than approvaltimeout ago,
+// which leaves requesters as long to collect a certificate as approvers had to decide on it
+func dbPruneApprovals(conf *config, now time.Time) (int, error) {
+	var old [][]byte
+
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conf.bucketNameApprovals)
+		if bucket == nil {
+			return nil
+		}
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			var ar approvalRequest
+			err := json.Unmarshal(v, &ar)
+			if err != nil {
+				return err
+			}
+			ar.expire()
+			if ar.Status == approvalPending {
+				return nil
+			}
+
+			done := ar.Expires
+			if ar.Decided != nil {
+				done = *ar.Decided
+			}
+			if now.Sub(done) > conf.approvalTimeout {
+				old = append(old, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Bolt doesn't allow deleting keys while iterating over them
+		for _, k := range old {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune approval requests from database: %v", err)
+	}
+
+	return len(old), nil
+}
+
+func dbListApprovals(conf *config, status string) ([]*approvalRequest, error) {
+	recs := []*approvalRequest{}
+
+	err := dbView(conf, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conf.bucketNameApprovals)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var ar approvalRequest
+			err := json.Unmarshal(v, &ar)
+			if err != nil {
+				return err
+			}
+			ar.expire()
+			if status == "" || ar.Status == status {
+				recs = append(recs, &ar)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval requests from database: %v", err)
+	}
+
+	return recs, nil
+}
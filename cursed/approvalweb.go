@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func approvalHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "approval", "")
+
+	// Requesters may check on their own requests, but only approvers may see or decide others
+	user, err := approverUser(conf, r)
+	if user == "" {
+		msg := fmt.Sprintf("authorization failure: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "no-client-cert"})
+		http.Error(w, "not authorized", code)
+		return
+	}
+	un = user
+	isApprover := err == nil
+
+	id := strings.TrimPrefix(r.URL.Path, "/approvals/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		// List the requests waiting on a decision
+		if !isApprover {
+			code := http.StatusForbidden
+			logger.audit(un, code, fmt.Sprintf("authorization failure: %v", err), auditInfo{Event: eventAuthzDenied, Reason: "not-approver"})
+			http.Error(w, "not authorized", code)
+			return
+		}
+
+		recs, err := dbListApprovals(conf, approvalPending)
+		if err != nil {
+			code := http.StatusInternalServerError
+			logger.req(un, code, err.Error())
+			http.Error(w, "server error", code)
+			return
+		}
+
+		logger.req(un, http.StatusOK, fmt.Sprintf("listed %d pending approval requests", len(recs)))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recs)
+	case r.Method == http.MethodGet:
+		// Check on a single request
+		ar, err := dbGetApproval(conf, id)
+		if err != nil {
+			code := http.StatusInternalServerError
+			logger.req(un, code, err.Error())
+			http.Error(w, "server error", code)
+			return
+		}
+		if ar == nil || (!isApprover && ar.Requester != user) {
+			code := http.StatusNotFound
+			logger.req(un, code, fmt.Sprintf("approval request not found: %s", id))
+			http.Error(w, "not found", code)
+			return
+		}
+		ar.expire()
+
+		// Only the requester gets the signed certificate
+		if ar.Requester != user {
+			ar.Cert = ""
+		}
+
+		logger.req(un, http.StatusOK, fmt.Sprintf("approval request[%s] status[%s]", ar.ID, ar.Status))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ar)
+	case r.Method == http.MethodPost && id != "":
+		// Approve or deny a request
+		if !isApprover {
+			code := http.StatusForbidden
+			logger.audit(un, code, fmt.Sprintf("authorization failure: %v", err), auditInfo{Event: eventAuthzDenied, Reason: "not-approver"})
+			http.Error(w, "not authorized", code)
+			return
+		}
+
+		p, err := getJSONParams(w, r, conf)
+		if err != nil {
+			msg := fmt.Sprintf("bad json in request: %v", err)
+			code := http.StatusBadRequest
+			logger.req(un, code, msg)
+			http.Error(w, "bad request", code)
+			return
+		}
+		if p.Decision != "approve" && p.Decision != "deny" {
+			msg := fmt.Sprintf("decision must be approve or deny: %q", p.Decision)
+			code := http.StatusBadRequest
+			logger.req(un, code, msg)
+			http.Error(w, msg, code)
+			return
+		}
+
+		ar, err := decideApproval(conf, id, user, p.Decision == "approve", p.Reason)
+		if err != nil {
+			code := http.StatusInternalServerError
+			switch err {
+			case errApprovalNotFound:
+				code = http.StatusNotFound
+			case errApprovalDecided:
+				code = http.StatusConflict
+			case errApprovalSelf:
+				code = http.StatusForbidden
+			}
+			if _, ok := err.(*lockdownError); ok {
+				code = http.StatusServiceUnavailable
+			}
+			msg := fmt.Sprintf("failed to %s approval request[%s]: %v", p.Decision, id, err)
+			ai := auditInfo{}
+			if err == errApprovalSelf {
+				ai = auditInfo{Event: eventAuthzDenied, Reason: "self-approval"}
+			}
+			logger.audit(un, code, msg, ai)
+			if code == http.StatusInternalServerError {
+				http.Error(w, "server error", code)
+			} else {
+				http.Error(w, err.Error(), code)
+			}
+			return
+		}
+
+		msg := fmt.Sprintf("approval request[%s] %s: user[%s] principal[%s] reason[%s]",
+			ar.ID, ar.Status, ar.Requester, ar.Principal, ar.Reason)
+		logger.audit(un, http.StatusOK, msg, auditInfo{Command: ar.Command, Event: eventApprovalDecided,
+			Fingerprint: ar.KeyID.SSHKey, KeyID: ar.certKeyID(), Principal: ar.Principal, Reason: ar.Status})
+		if ar.Status == approvalApproved {
+			conf.webhooks.notify(webhookEvent{Type: eventSSHCertIssued, CertType: "user", IP: ar.BastionIP,
+				Fingerprint: ar.KeyID.SSHKey, KeyID: ar.certKeyID(), Principal: ar.Principal,
+				Reason: "approved by " + user, User: ar.Requester, UserIP: ar.UserIP})
+		}
+
+		ar.Cert = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ar)
+	default:
+		code := http.StatusMethodNotAllowed
+		logger.req(un, code, fmt.Sprintf("method not allowed: %s %s", r.Method, r.URL.Path))
+		http.Error(w, "method not allowed", code)
+	}
+}
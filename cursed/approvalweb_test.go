@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestApprovalConf sets up root to need approval, with alice and carol as approvers
+func newTestApprovalConf(t *testing.T, ca *testUserCA) *config {
+	t.Helper()
+
+	conf := newTestHandlerConf(t, ca)
+	conf.Approvers = []string{"alice", "carol"}
+	conf.PrincipalLimits = map[string]*principalLimit{"root": {RequireApproval: true}}
+	conf.approvalTimeout = time.Minute
+
+	return conf
+}
+
+// requestTestApproval asks for a root certificate as user, returning the pending approval request
+func requestTestApproval(t *testing.T, conf *config, ca *testUserCA, user string) *approvalRequest {
+	t.Helper()
+
+	key := newTestSigner(t)
+	n, _, err := conf.challenges.issue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := testCertRequest(t, conf, ca.request(t, user, "POST", "/", httpParams{
+		BastionIP:  "10.0.0.1",
+		Key:        string(ssh.MarshalAuthorizedKey(key.PublicKey())),
+		Nonce:      n,
+		RemoteUser: "root",
+		Signature:  signTestProof(t, key, n),
+	}))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d %s, want an approval request", w.Code, w.Body)
+	}
+
+	var ar approvalRequest
+	err = json.Unmarshal(w.Body.Bytes(), &ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Location") != "/approvals/"+ar.ID || ar.Status != approvalPending {
+		t.Fatalf("got approval request %+v at %s", ar, w.Header().Get("Location"))
+	}
+
+	return &ar
+}
+
+func testApproval(t *testing.T, conf *config, r *http.Request) (*httptest.ResponseRecorder, *approvalRequest) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	approvalHandler(w, r, conf)
+
+	var ar *approvalRequest
+	if w.Code == http.StatusOK {
+		ar = &approvalRequest{}
+		err := json.Unmarshal(w.Body.Bytes(), ar)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return w, ar
+}
+
+func TestApprovalWorkflow(t *testing.T) {
+	ca := newTestUserCA(t)
+	conf := newTestApprovalConf(t, ca)
+	ar := requestTestApproval(t, conf, ca, "alice")
+	path := "/approvals/" + ar.ID
+	approve := httpParams{Decision: "approve", Reason: "CHG-1234"}
+
+	// Approvers can't approve their own requests
+	if w, _ := testApproval(t, conf, ca.request(t, "alice", "POST", path, approve)); w.Code != http.StatusForbidden {
+		t.Errorf("self-approval: got %d %s", w.Code, w.Body)
+	}
+
+	// Nor can anyone who isn't an approver
+	if w, _ := testApproval(t, conf, ca.request(t, "bob", "POST", path, approve)); w.Code != http.StatusForbidden {
+		t.Errorf("approval by non-approver: got %d %s", w.Code, w.Body)
+	}
+
+	// Other requesters can't see the request at all
+	if w, _ := testApproval(t, conf, ca.request(t, "bob", "GET", path, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("request read by another user: got %d %s", w.Code, w.Body)
+	}
+	if w, _ := testApproval(t, conf, ca.request(t, "bob", "GET", "/approvals/", nil)); w.Code != http.StatusForbidden {
+		t.Errorf("pending requests listed by non-approver: got %d %s", w.Code, w.Body)
+	}
+
+	w, got := testApproval(t, conf, ca.request(t, "carol", "POST", path, approve))
+	if w.Code != http.StatusOK || got.Status != approvalApproved || got.Approver != "carol" {
+		t.Fatalf("approval: got %d %s", w.Code, w.Body)
+	}
+	if got.Cert != "" {
+		t.Error("certificate returned to the approver")
+	}
+
+	// Only the requester gets the certificate
+	_, got = testApproval(t, conf, ca.request(t, "carol", "GET", path, nil))
+	if got == nil || got.Status != approvalApproved || got.Cert != "" {
+		t.Errorf("approver's view of the request: %+v", got)
+	}
+	_, got = testApproval(t, conf, ca.request(t, "alice", "GET", path, nil))
+	if got == nil || got.Cert == "" {
+		t.Fatalf("requester's view of the request: %+v", got)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(got.Cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, ok := pub.(*ssh.Certificate); !ok || len(cert.ValidPrincipals) != 1 || cert.ValidPrincipals[0] != "root" {
+		t.Errorf("got certificate %+v, want one for root", pub)
+	}
+
+	// Each request is only decided once
+	deny := httpParams{Decision: "deny"}
+	if w, _ := testApproval(t, conf, ca.request(t, "alice", "POST", path, deny)); w.Code != http.StatusConflict {
+		t.Errorf("second decision: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestApprovalExpired(t *testing.T) {
+	ca := newTestUserCA(t)
+	conf := newTestApprovalConf(t, ca)
+	ar := requestTestApproval(t, conf, ca, "bob")
+	path := "/approvals/" + ar.ID
+
+	// Let the request run out of time
+	stored, err := dbGetApproval(conf, ar.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Expires = time.Now().Add(-time.Second)
+	err = dbPutApproval(conf, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ := testApproval(t, conf, ca.request(t, "carol", "POST", path, httpParams{Decision: "approve"}))
+	if w.Code != http.StatusConflict {
+		t.Errorf("approval of expired request: got %d %s", w.Code, w.Body)
+	}
+	_, got := testApproval(t, conf, ca.request(t, "bob", "GET", path, nil))
+	if got == nil || got.Status != approvalExpired || got.Cert != "" {
+		t.Errorf("got expired request %+v", got)
+	}
+	if recs, _ := dbListApprovals(conf, approvalPending); len(recs) != 0 {
+		t.Errorf("expired request still listed as pending: %+v", recs)
+	}
+}
+
+func TestApprovalPruning(t *testing.T) {
+	ca := newTestUserCA(t)
+	conf := newTestApprovalConf(t, ca)
+	now := time.Now()
+
+	// Decided and expired requests are kept for approvaltimeout, pending requests until they expire
+	decided := now.Add(-2 * time.Minute)
+	recent := now.Add(-30 * time.Second)
+	for _, ar := range []*approvalRequest{
+		{ID: "old-decided", Status: approvalApproved, Decided: &decided, Expires: now.Add(time.Hour)},
+		{ID: "new-decided", Status: approvalDenied, Decided: &recent, Expires: now.Add(time.Hour)},
+		{ID: "old-expired", Status: approvalPending, Expires: now.Add(-2 * time.Minute)},
+		{ID: "new-expired", Status: approvalPending, Expires: now.Add(-30 * time.Second)},
+		{ID: "pending", Status: approvalPending, Expires: now.Add(time.Minute)},
+	} {
+		err := dbPutApproval(conf, ar)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// New requests clear out the old ones
+	requestTestApproval(t, conf, ca, "bob")
+	for id, kept := range map[string]bool{
+		"old-decided": false,
+		"new-decided": true,
+		"old-expired": false,
+		"new-expired": true,
+		"pending":     true,
+	} {
+		ar, err := dbGetApproval(conf, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (ar != nil) != kept {
+			t.Errorf("request %s: got kept %v, want %v", id, ar != nil, kept)
+		}
+	}
+}
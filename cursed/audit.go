@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Audit event names, alongside the webhook event types
+const (
+	eventApprovalDecided   = "approval-decided"
+	eventApprovalRequested = "approval-requested"
+	eventCARotated         = "ca-rotated"
+	eventHostCertIssued    = "host-cert-issued"
+	eventLockdown          = "lockdown"
+	eventPubKeyRegistered  = "pubkey-registered"
+	eventRateLimited       = "rate-limited"
+	eventRequest           = "request"
+	eventRevocation        = "revocation"
+)
+
+// Audit levels, in increasing order of severity
+var auditLevels = map[string]int{
+	"info":     0,
+	"warning":  1,
+	"error":    2,
+	"critical": 3,
+}
+
+// RFC5424 severities for each audit level
+var syslogSeverities = map[string]int{
+	"info":     6,
+	"warning":  4,
+	"error":    3,
+	"critical": 2,
+}
+
+var syslogFacilities = map[string]int{
+	"user":     1,
+	"daemon":   3,
+	"auth":     4,
+	"authpriv": 10,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+type auditEvent struct {
+	Code        int       `json:"code"`
+	Command     string    `json:"cmd,omitempty"`
+	Event       string    `json:"event"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Handler     string    `json:"handler"`
+	IP          string    `json:"ip"`
+	KeyID       string    `json:"key_id,omitempty"`
+	Level       string    `json:"level"`
+	Msg         string    `json:"msg"`
+	Principal   string    `json:"principal,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	UserIP      string    `json:"user_ip,omitempty"`
+}
+
+type logSink struct {
+	Address  string
+	Events   []string
+	Facility string
+	Level    string
+	Network  string
+	Path     string
+	Type     string
+
+	conn     net.Conn
+	events   map[string]bool
+	facility int
+	file     *os.File
+	hostname string
+	level    int
+	mu       sync.Mutex
+}
+
+type auditLogger struct {
+	sinks []*logSink
+}
+
+func newAuditLogger(sinks []*logSink) (*auditLogger, error) {
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	al := &auditLogger{}
+	for _, s := range sinks {
+		if s == nil {
+			return nil, fmt.Errorf("empty logsinks entry")
+		}
+
+		if s.Level == "" {
+			s.Level = "info"
+		}
+		level, ok := auditLevels[s.Level]
+		if !ok {
+			return nil, fmt.Errorf("invalid log sink level: %s", s.Level)
+		}
+		s.level = level
+
+		s.events = make(map[string]bool)
+		for _, e := range s.Events {
+			s.events[e] = true
+		}
+
+		switch s.Type {
+		case "stdout":
+		case "file":
+			if s.Path == "" {
+				return nil, fmt.Errorf("file log sinks require a path")
+			}
+			s.Path = expandHome(s.Path)
+			err := s.reopen()
+			if err != nil {
+				return nil, err
+			}
+		case "syslog":
+			// Each write is sent as one datagram, which is one message. Stream sockets would need
+			// RFC6587 framing, which local syslog daemons don't agree on
+			if s.Network != "unixgram" && s.Network != "udp" {
+				return nil, fmt.Errorf("syslog log sinks require a network of unixgram or udp: %q", s.Network)
+			}
+			if s.Address == "" {
+				return nil, fmt.Errorf("syslog log sinks require an address")
+			}
+			if s.Facility == "" {
+				s.Facility = "authpriv"
+			}
+			s.facility, ok = syslogFacilities[s.Facility]
+			if !ok {
+				return nil, fmt.Errorf("invalid syslog facility: %s", s.Facility)
+			}
+			s.hostname, _ = os.Hostname()
+			if s.hostname == "" {
+				s.hostname = "-"
+			}
+		default:
+			return nil, fmt.Errorf("invalid log sink type: %q", s.Type)
+		}
+
+		al.sinks = append(al.sinks, s)
+	}
+
+	return al, nil
+}
+
+// auditLevel is the level of requests whose handler didn't give one. Only handlers mark events critical
+func auditLevel(code int) string {
+	switch {
+	case code >= 500:
+		return "error"
+	case code >= 400:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+func (al *auditLogger) write(ev *auditEvent) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("failed to encode audit event: %v", err)
+		return
+	}
+
+	for _, s := range al.sinks {
+		if auditLevels[ev.Level] < s.level {
+			continue
+		}
+		if len(s.events) > 0 && !s.events[ev.Event] && !s.events[ev.Handler] {
+			continue
+		}
+
+		err = s.write(ev, line)
+		if err != nil {
+			log.Printf("failed to write audit event to %s log sink: %v", s.Type, err)
+		}
+	}
+}
+
+func (s *logSink) write(ev *auditEvent, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.Type {
+	case "stdout":
+		_, err := fmt.Fprintf(os.Stdout, "%s\n", line)
+		return err
+	case "file":
+		_, err := fmt.Fprintf(s.file, "%s\n", line)
+		return err
+	case "syslog":
+		// RFC5424: <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+		msg := fmt.Sprintf("<%d>1 %s %s cursed %d %s - %s", s.facility*8+syslogSeverities[ev.Level],
+			ev.Time.Format(time.RFC3339Nano), s.hostname, os.Getpid(), ev.Event, line)
+
+		// Reconnect once if the syslog daemon went away
+		var err error
+		for attempt := 0; attempt < 2; attempt++ {
+			if s.conn == nil {
+				s.conn, err = net.Dial(s.Network, s.Address)
+				if err != nil {
+					continue
+				}
+			}
+			_, err = s.conn.Write([]byte(msg))
+			if err == nil {
+				return nil
+			}
+			s.conn.Close()
+			s.conn = nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *logSink) reopen() error {
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log file: %v", err)
+	}
+
+	s.mu.Lock()
+	old := s.file
+	s.file = f
+	s.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
+
+func (al *auditLogger) reopenOnSignal() {
+	if al == nil {
+		return
+	}
+
+	// Reopen our log files on SIGUSR1, so they can be rotated
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			for _, s := range al.sinks {
+				if s.Type != "file" {
+					continue
+				}
+				err := s.reopen()
+				if err != nil {
+					log.Printf("%v", err)
+				}
+			}
+		}
+	}()
+}
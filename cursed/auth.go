@@ -4,10 +4,19 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os/exec"
+	"time"
 )
 
 func pwauth(conf *config, user, pass string) (bool, error) {
+	// Limit how many auth helpers we run at once
+	err := acquireExec(conf)
+	if err != nil {
+		return false, err
+	}
+	defer releaseExec(conf)
+
 	// Build our timeout context
 	ctx, cancel := context.WithTimeout(context.Background(), conf.authTimeout)
 	defer cancel()
@@ -20,6 +29,7 @@ func pwauth(conf *config, user, pass string) (bool, error) {
 	}
 
 	// Run pwauth
+	start := time.Now()
 	err = cmd.Start()
 	if err != nil {
 		return false, fmt.Errorf("failed to start pwauth: %v", err)
@@ -31,6 +41,7 @@ func pwauth(conf *config, user, pass string) (bool, error) {
 	}
 	// Wait for pwauth to complete
 	err = cmd.Wait()
+	conf.metrics.observeExec("pwauth", start, ctx.Err() == context.DeadlineExceeded)
 	if err != nil {
 		return false, fmt.Errorf("pwauth failed: %v", err)
 	}
@@ -40,29 +51,57 @@ func pwauth(conf *config, user, pass string) (bool, error) {
 
 func unixgroup(conf *config, user, principal string) error {
 	// If this is a wildcard ACL, allow immediately
-	groups := conf.principalMap[principal]
-	if groups == "*" {
+	groups := conf.aliases.groups(principal)
+	if len(groups) == 1 && groups[0] == "*" {
 		return nil
-	} else if groups == "" {
+	} else if len(groups) == 0 {
 		return fmt.Errorf("unknown principal: %s", principal)
 	}
 
-	// Build our timeout context
-	ctx, cancel := context.WithTimeout(context.Background(), conf.authTimeout)
-	defer cancel()
+	return checkGroups(conf, user, groups)
+}
 
-	// Build our command with context for timeout
-	cmd := exec.CommandContext(ctx, conf.Unixgroup)
+func checkGroups(conf *config, user string, groups []string) error {
+	// Each authorizer limits how many group lookups it runs at once
+	return conf.authorizer.checkGroups(conf, user, groups)
+}
 
-	// Set our env variables
-	cmd.Env = append(cmd.Env, fmt.Sprintf("USER=%s", user))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("GROUP=%s", groups))
+func adminUser(conf *config, r *http.Request) (string, error) {
+	// Admins authenticate with a user identity certificate
+	cert, err := verifyClientCert(r, conf.tlsUserCAPool)
+	if err != nil {
+		return "", fmt.Errorf("no valid client certificate provided: %v", err)
+	}
+
+	user := cert.Subject.CommonName
+	for _, admin := range conf.Admins {
+		if user == admin {
+			return user, nil
+		}
+	}
+
+	return user, fmt.Errorf("user is not an admin: %s", user)
+}
 
-	// Run unixgroup
-	err := cmd.Run()
+func approverUser(conf *config, r *http.Request) (string, error) {
+	// Approvers authenticate with a user identity certificate
+	cert, err := verifyClientCert(r, conf.tlsUserCAPool)
 	if err != nil {
-		return fmt.Errorf("invalid groups or unixgroup command error: (user: %s) %v", user, err)
+		return "", fmt.Errorf("no valid client certificate provided: %v", err)
+	}
+
+	// Admins approve requests unless a separate list of approvers is configured
+	approvers := conf.Approvers
+	if len(approvers) == 0 {
+		approvers = conf.Admins
+	}
+
+	user := cert.Subject.CommonName
+	for _, approver := range approvers {
+		if user == approver {
+			return user, nil
+		}
 	}
 
-	return nil
+	return user, fmt.Errorf("user is not an approver: %s", user)
 }
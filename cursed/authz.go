@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// Backends that check whether a user belongs to any of a list of unix groups
+type groupAuthorizer interface {
+	checkGroups(conf *config, user string, groups []string) error
+}
+
+// Returned when the backend answered, and the user isn't in any of the groups. Any other error
+// means the backend couldn't answer
+type notMemberError struct {
+	error
+}
+
+// Runs the unixgroup helper, which exits non-zero unless the user is in one of the groups
+type execAuthorizer struct{}
+
+// Looks up group membership in-process through NSS
+type nssAuthorizer struct{}
+
+func newGroupAuthorizer(name string) (groupAuthorizer, error) {
+	switch name {
+	case "exec":
+		return execAuthorizer{}, nil
+	case "nss":
+		if !nssCgo {
+			log.Print("authorizer is nss, but cursed was built without cgo. Group lookups will only read /etc/group, not LDAP or SSSD")
+		}
+		return nssAuthorizer{}, nil
+	}
+
+	return nil, fmt.Errorf("invalid authorizer (must be exec or nss): %s", name)
+}
+
+func (execAuthorizer) checkGroups(conf *config, user string, groups []string) error {
+	// Limit how many helpers we run at once
+	err := acquireExec(conf)
+	if err != nil {
+		return err
+	}
+	defer releaseExec(conf)
+
+	// Build our timeout context
+	ctx, cancel := context.WithTimeout(context.Background(), conf.authTimeout)
+	defer cancel()
+
+	// Build our command with context for timeout
+	cmd := exec.CommandContext(ctx, conf.Unixgroup)
+
+	// Set our env variables
+	cmd.Env = append(cmd.Env, fmt.Sprintf("USER=%s", user))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("GROUP=%s", strings.Join(groups, ",")))
+
+	// Run unixgroup
+	start := time.Now()
+	err = cmd.Run()
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	conf.metrics.observeExec("unixgroup", start, timedOut)
+
+	// A helper that ran to completion and exited non-zero is telling us the user isn't a member
+	if _, ok := err.(*exec.ExitError); ok && !timedOut {
+		return &notMemberError{fmt.Errorf("invalid groups: (user: %s) %v", user, err)}
+	}
+	if err != nil {
+		return fmt.Errorf("unixgroup command error: (user: %s) %v", user, err)
+	}
+
+	return nil
+}
+
+func (nssAuthorizer) checkGroups(conf *config, user string, groups []string) error {
+	// Limit how many lookups we run at once. A lookup we've given up waiting on keeps its slot
+	// until it returns, so hung lookups can't pile up past execconcurrency
+	err := acquireExec(conf)
+	if err != nil {
+		return err
+	}
+
+	// NSS lookups can hang on a slow directory server, and can't be cancelled, so give up
+	// waiting after our auth timeout
+	result := make(chan error, 1)
+	go func() {
+		defer releaseExec(conf)
+		result <- nssCheckGroups(user, groups)
+	}()
+
+	timer := time.NewTimer(conf.authTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("group lookup timed out: (user: %s)", user)
+	}
+}
+
+func nssCheckGroups(name string, groups []string) error {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		return &notMemberError{err}
+	}
+	if err != nil {
+		return fmt.Errorf("user lookup failed: %v", err)
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return fmt.Errorf("group lookup failed: (user: %s) %v", name, err)
+	}
+
+	member := make(map[string]bool)
+	for _, gid := range gids {
+		member[gid] = true
+	}
+
+	// Compare by gid, since a group may have more than one name
+	var lookupErr error
+	for _, g := range groups {
+		grp, err := user.LookupGroup(g)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			continue
+		}
+		if err != nil {
+			lookupErr = err
+			continue
+		}
+		if member[grp.Gid] {
+			return nil
+		}
+	}
+
+	// We can't say they're not a member if one of the groups couldn't be looked up
+	if lookupErr != nil {
+		return fmt.Errorf("group lookup failed: (user: %s) %v", name, lookupErr)
+	}
+
+	return &notMemberError{fmt.Errorf("user %s is not in any of the groups: %s", name, strings.Join(groups, ","))}
+}
@@ -0,0 +1,6 @@
+//go:build cgo
+
+package main
+
+// With cgo, os/user looks users and groups up through the system's NSS modules (LDAP, SSSD, etc.)
+const nssCgo = true
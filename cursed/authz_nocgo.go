@@ -0,0 +1,6 @@
+//go:build !cgo
+
+package main
+
+// Without cgo, os/user only reads /etc/passwd and /etc/group
+const nssCgo = false
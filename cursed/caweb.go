@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func caBundleHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	var (
+		body        []byte
+		contentType string
+	)
+
+	switch r.URL.Path {
+	case "/ca/ssh":
+		// Bundle of trusted user CA pubkeys for sshd's TrustedUserCAKeys
+		var buf bytes.Buffer
+		for _, pk := range conf.sshCA.trusted() {
+			buf.Write(ssh.MarshalAuthorizedKey(pk))
+		}
+		body = buf.Bytes()
+		contentType = "text/plain; charset=utf-8"
+	case "/ca/ssh-host":
+		// known_hosts line trusting our host CA for all hosts
+		if conf.sshHostCASigner == nil {
+			http.NotFound(w, r)
+			return
+		}
+		body = []byte(fmt.Sprintf("@cert-authority * %s", ssh.MarshalAuthorizedKey(conf.sshHostCASigner.PublicKey())))
+		contentType = "text/plain; charset=utf-8"
+	case "/ca/tls":
+		body = conf.tlsCABundle
+		contentType = "application/x-pem-file"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Tag the bundle with a hash of its contents so clients can cheaply check for changes
+	sum := sha256.Sum256(body)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:])))
+
+	// ServeContent handles If-None-Match and HEAD requests for us
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
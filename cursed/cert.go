@@ -1,27 +1,59 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 type certConfig struct {
-	certType    uint32
-	command     string
-	extensions  map[string]string
-	keyID       string
-	principals  []string
-	srcAddr     string
-	validAfter  time.Time
-	validBefore time.Time
+	acl            *aclRule
+	certType       uint32
+	command        string
+	extensions     map[string]string
+	keyID          string
+	principals     []string
+	requester      string
+	srcAddr        string
+	userIP         string
+	validAfter     time.Time
+	validBefore    time.Time
+	verifyRequired bool
 }
 
-func checkPubKeyAge(conf *config, fp string) (bool, error) {
+type pubKeyOwnerError struct {
+	fp    string
+	owner string
+	user  string
+}
+
+func (e *pubKeyOwnerError) Error() string {
+	return fmt.Sprintf("pubkey %s is registered to %s, but was presented by %s", e.fp, e.owner, e.user)
+}
+
+func checkPubKeyAge(conf *config, pk ssh.PublicKey, user string) (bool, error) {
+	fp := ssh.FingerprintSHA256(pk)
+
+	// Carry over anything we recorded about this pubkey under its old MD5 fingerprint
+	err := dbRekeyLegacyFP(conf, ssh.FingerprintLegacyMD5(pk), fp)
+	if err != nil {
+		return true, err
+	}
+
+	// Bind the pubkey to the first user to present it, and refuse it from anyone else
+	owner, err := dbClaimPubKey(conf, fp, user)
+	if err != nil {
+		return true, err
+	}
+	if owner != user {
+		return true, &pubKeyOwnerError{fp: fp, owner: owner, user: user}
+	}
 
 	// Check our key's age from the DB
 	keyBirthday, ok, err := dbGetPubKeyAge(conf, fp)
@@ -51,22 +83,9 @@ func checkPubKeyAge(conf *config, fp string) (bool, error) {
 	return false, nil
 }
 
-func loadSSHCA(conf *config) (ssh.Signer, []byte, error) {
-	// Read in our private key PEM file
-	key, err := ioutil.ReadFile(conf.CAKeyFile)
-	if err != nil {
-		err = fmt.Errorf("failed to read ca key file: '%v'", err)
-		return nil, nil, err
-	}
-
-	sk, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		err = fmt.Errorf("failed to parse ca key: '%v'", err)
-		return nil, nil, err
-	}
-
+func loadSSHCA(conf *config, keyFile, backend string) (ssh.Signer, []byte, error) {
 	// Get our CA fingerprint
-	rawPub, err := ioutil.ReadFile(fmt.Sprintf("%s.pub", conf.CAKeyFile))
+	rawPub, err := ioutil.ReadFile(fmt.Sprintf("%s.pub", keyFile))
 	if err != nil {
 		err = fmt.Errorf("failed to read ca pubkey file: '%v'", err)
 		return nil, nil, err
@@ -82,6 +101,45 @@ func loadSSHCA(conf *config) (ssh.Signer, []byte, error) {
 	// Get the key's fingerprint for logging
 	fp := ssh.FingerprintSHA256(pubKey)
 
+	// Set up the signer backend holding our private key
+	var sk ssh.Signer
+	switch backend {
+	case caBackendFile, "":
+		// Read in our private key PEM file
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			err = fmt.Errorf("failed to read ca key file: '%v'", err)
+			return nil, nil, err
+		}
+
+		sk, err = ssh.ParsePrivateKey(key)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			// Decrypt the key with our configured passphrase
+			var pass []byte
+			pass, err = conf.caPass.get()
+			if err != nil {
+				return nil, nil, err
+			}
+			sk, err = ssh.ParsePrivateKeyWithPassphrase(key, pass)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to parse ca key: '%v'", err)
+			return nil, nil, err
+		}
+		if !bytes.Equal(sk.PublicKey().Marshal(), pubKey.Marshal()) {
+			return nil, nil, fmt.Errorf("ca key %s does not match its pubkey file", keyFile)
+		}
+	case caBackendAgent:
+		sk, err = newAgentSigner(conf.CAAgentSocket, pubKey)
+	case caBackendRemote:
+		sk, err = newRemoteSigner(conf, pubKey)
+	default:
+		err = fmt.Errorf("invalid ca backend: %s", backend)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load ca key %s: %v", keyFile, err)
+	}
+
 	return sk, []byte(fp), nil
 }
 
@@ -91,10 +149,27 @@ func signPubKey(conf *config, rawKey []byte, cc certConfig) ([]byte, error) {
 		return nil, fmt.Errorf("failed to parse pubkey: %v", err)
 	}
 
+	// Enforce the access policy rule this request was authorized under
+	if cc.acl != nil {
+		err = cc.acl.apply(&cc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Host certificates are signed by their own CA
+	signer, caFP := conf.sshCA.active()
+	if cc.certType == ssh.HostCert {
+		signer, caFP = conf.sshHostCASigner, conf.sshHostCAFP
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("no ca key loaded for certificate type %d", cc.certType)
+	}
+
 	// Get/update our ssh cert serial number
 	var serial uint64
 	if conf.SSHSerial {
-		serial, err = dbIncSSHSerial(conf)
+		serial, err = dbIncSSHSerial(conf, caFP)
 		if err != nil {
 			return nil, err
 		}
@@ -106,7 +181,12 @@ func signPubKey(conf *config, rawKey []byte, cc certConfig) ([]byte, error) {
 	if cc.command != "" {
 		critOpt["force-command"] = cc.command
 	}
-	critOpt["source-address"] = cc.srcAddr
+	if cc.srcAddr != "" {
+		critOpt["source-address"] = cc.srcAddr
+	}
+	if cc.verifyRequired {
+		critOpt["verify-required"] = ""
+	}
 
 	perms := ssh.Permissions{
 		CriticalOptions: critOpt,
@@ -125,12 +205,43 @@ func signPubKey(conf *config, rawKey []byte, cc certConfig) ([]byte, error) {
 		Permissions:     perms,
 	}
 
-	err = cert.SignCert(rand.Reader, conf.sshCASigner)
+	start := time.Now()
+	err = cert.SignCert(rand.Reader, signer)
 	if err != nil {
 		err = fmt.Errorf("failed to sign pubkey: %v", err)
 		return nil, err
 	}
+	if cc.certType == ssh.HostCert {
+		conf.metrics.observeSign("ssh-host", start)
+	} else {
+		conf.metrics.observeSign("ssh-user", start)
+	}
 	authorizedKey := ssh.MarshalAuthorizedKey(cert)
 
-	return authorizedKey, err
+	// Record the certificate in our issuance ledger
+	rec := &issuedCert{
+		Type:        issuedSSHUser,
+		KeyID:       cc.keyID,
+		Principals:  cc.principals,
+		ValidAfter:  cc.validAfter.UTC(),
+		ValidBefore: cc.validBefore.UTC(),
+		CA:          string(caFP),
+		Fingerprint: ssh.FingerprintSHA256(pubKey),
+		Requester:   cc.requester,
+		BastionIP:   cc.srcAddr,
+		UserIP:      cc.userIP,
+		IssuedAt:    time.Now().UTC(),
+	}
+	if cc.certType == ssh.HostCert {
+		rec.Type = issuedSSHHost
+	}
+	if conf.SSHSerial {
+		rec.Serial = strconv.FormatUint(serial, 10)
+	}
+	err = dbAddIssuedCert(conf, rec)
+	if err != nil {
+		return nil, err
+	}
+
+	return authorizedKey, nil
 }
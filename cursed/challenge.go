@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// challengePrefix is prepended to a nonce before signing, so a proof can't be replayed as any other kind of signature
+const challengePrefix = "curse-challenge-v1:"
+
+type challenge struct {
+	expires time.Time
+	user    string
+}
+
+type challengeStore struct {
+	mu      sync.Mutex
+	pending map[string]challenge
+	ttl     time.Duration
+}
+
+func newChallengeStore(ttl time.Duration) *challengeStore {
+	return &challengeStore{
+		pending: make(map[string]challenge),
+		ttl:     ttl,
+	}
+}
+
+// setTTL changes the lifetime of nonces issued from now on
+func (s *challengeStore) setTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ttl = ttl
+}
+
+func (s *challengeStore) issue(user string) (string, time.Time, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Clear out any challenges that were never used
+	now := time.Now()
+	for k, c := range s.pending {
+		if now.After(c.expires) {
+			delete(s.pending, k)
+		}
+	}
+
+	expires := now.Add(s.ttl)
+	s.pending[nonce] = challenge{expires: expires, user: user}
+
+	return nonce, expires, nil
+}
+
+func (s *challengeStore) consume(nonce, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Nonces are single use, whether or not this attempt succeeds
+	c, ok := s.pending[nonce]
+	if !ok {
+		return fmt.Errorf("unknown or already used nonce")
+	}
+	delete(s.pending, nonce)
+
+	if time.Now().After(c.expires) {
+		return fmt.Errorf("nonce expired at %s", c.expires.Format(time.RFC3339))
+	}
+	if c.user != user {
+		return fmt.Errorf("nonce was issued to %s", c.user)
+	}
+
+	return nil
+}
+
+func verifyKeyProof(conf *config, pk ssh.PublicKey, p httpParams) error {
+	if p.Nonce == "" || p.Signature == "" {
+		return fmt.Errorf("nonce and signature are required")
+	}
+
+	err := conf.challenges.consume(p.Nonce, p.user)
+	if err != nil {
+		return err
+	}
+
+	// Decode the signature from its ssh wire format
+	b, err := base64.StdEncoding.DecodeString(p.Signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64: %v", err)
+	}
+	var sig ssh.Signature
+	err = ssh.Unmarshal(b, &sig)
+	if err != nil {
+		return fmt.Errorf("failed to parse signature: %v", err)
+	}
+
+	err = pk.Verify([]byte(challengePrefix+p.Nonce), &sig)
+	if err != nil {
+		return fmt.Errorf("signature does not match pubkey: %v", err)
+	}
+
+	return nil
+}
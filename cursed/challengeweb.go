@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type challengeResponse struct {
+	Expires time.Time `json:"expires"`
+	Nonce   string    `json:"nonce"`
+}
+
+func challengeHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "challenge", "")
+
+	// Nonces are bound to the user identity in the client certificate
+	clientCert, err := verifyClientCert(r, conf.tlsUserCAPool)
+	if err != nil {
+		msg := fmt.Sprintf("no valid client certificate provided: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "no-client-cert"})
+		http.Error(w, "not authorized", code)
+		return
+	}
+	un = clientCert.Subject.CommonName
+
+	nonce, expires, err := conf.challenges.issue(un)
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+
+	// Log the request
+	code := http.StatusOK
+	logger.req(un, code, fmt.Sprintf("issued nonce expiring %s", expires.Format(time.RFC3339)))
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(challengeResponse{Expires: expires, Nonce: nonce})
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"strconv"
@@ -10,8 +12,22 @@ import (
 	"github.com/boltdb/bolt"
 )
 
+// Key holding the KRL version counter in the revocation bucket. The leading NUL keeps it from
+// colliding with revocation keys
+var krlVersionKey = []byte("\x00krlversion")
+
+func dbView(conf *config, fn func(*bolt.Tx) error) error {
+	defer conf.metrics.observeBoltTx("view", time.Now())
+	return conf.db.View(fn)
+}
+
+func dbUpdate(conf *config, fn func(*bolt.Tx) error) error {
+	defer conf.metrics.observeBoltTx("update", time.Now())
+	return conf.db.Update(fn)
+}
+
 func dbAddPubKeyBday(conf *config, fp string) error {
-	err := conf.db.Update(func(tx *bolt.Tx) error {
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameFP)
 		if err != nil {
 			return err
@@ -36,7 +52,7 @@ func dbGetPubKeyAge(conf *config, fp string) (int64, bool, error) {
 	)
 
 	// Check if this fingerprint exists in our DB
-	err := conf.db.View(func(tx *bolt.Tx) error {
+	err := dbView(conf, func(tx *bolt.Tx) error {
 		var err error
 
 		bucket := tx.Bucket(conf.bucketNameFP)
@@ -70,7 +86,7 @@ func dbGetPubKeyAge(conf *config, fp string) (int64, bool, error) {
 }
 
 func dbInitPubKeyBucket(conf *config) error {
-	err := conf.db.Update(func(tx *bolt.Tx) error {
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(conf.bucketNameFP)
 
 		return err
@@ -79,11 +95,11 @@ func dbInitPubKeyBucket(conf *config) error {
 	return err
 }
 
-func dbIncSSHSerial(conf *config) (uint64, error) {
+func dbIncSSHSerial(conf *config, caFP []byte) (uint64, error) {
 	var newSerial uint64
-	key := conf.sshCAFP
+	key := caFP
 
-	err := conf.db.Update(func(tx *bolt.Tx) error {
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameSSHSerial)
 		if err != nil {
 			return err
@@ -119,10 +135,10 @@ func dbIncSSHSerial(conf *config) (uint64, error) {
 	return newSerial, nil
 }
 
-func dbSetSSHSerial(conf *config, serial uint64) error {
-	key := conf.sshCAFP
+func dbSetSSHSerial(conf *config, caFP []byte, serial uint64) error {
+	key := caFP
 
-	err := conf.db.Update(func(tx *bolt.Tx) error {
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameSSHSerial)
 		if err != nil {
 			return err
@@ -149,7 +165,7 @@ func dbIncTLSSerial(conf *config) (*big.Int, error) {
 	var newSerial *big.Int
 	key := []byte("serial")
 
-	err := conf.db.Update(func(tx *bolt.Tx) error {
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameTLSSerial)
 		if err != nil {
 			return err
@@ -180,7 +196,7 @@ func dbIncTLSSerial(conf *config) (*big.Int, error) {
 func dbSetTLSSerial(conf *config, serial *big.Int) error {
 	key := []byte("serial")
 
-	err := conf.db.Update(func(tx *bolt.Tx) error {
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameTLSSerial)
 		if err != nil {
 			return err
@@ -199,3 +215,352 @@ func dbSetTLSSerial(conf *config, serial *big.Int) error {
 
 	return nil
 }
+
+func dbAddRevocation(conf *config, rev *revocation) error {
+	val, err := json.Marshal(rev)
+	if err != nil {
+		return fmt.Errorf("failed to encode revocation: %v", err)
+	}
+
+	err = dbUpdate(conf, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameRevoked)
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put(rev.dbKey(), val)
+		if err != nil {
+			return err
+		}
+
+		// Bump the KRL version so sshd can tell the list has changed
+		var version uint64
+		vb := bucket.Get(krlVersionKey)
+		if len(vb) == 8 {
+			version = binary.BigEndian.Uint64(vb)
+		}
+		nb := make([]byte, 8)
+		binary.BigEndian.PutUint64(nb, version+1)
+
+		return bucket.Put(krlVersionKey, nb)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save revocation to database: %v", err)
+	}
+
+	return nil
+}
+
+func dbGetRevocations(conf *config) ([]*revocation, uint64, error) {
+	var (
+		revs    []*revocation
+		version uint64
+	)
+
+	err := dbView(conf, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conf.bucketNameRevoked)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, krlVersionKey) {
+				version = binary.BigEndian.Uint64(v)
+				return nil
+			}
+
+			var rev revocation
+			err := json.Unmarshal(v, &rev)
+			if err != nil {
+				return fmt.Errorf("revocation in db corrupted for key %s: %v", k, err)
+			}
+			revs = append(revs, &rev)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read revocations from database: %v", err)
+	}
+
+	return revs, version, nil
+}
+
+func dbHasRevocation(conf *config, keys [][]byte) (bool, error) {
+	var found bool
+
+	err := dbView(conf, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conf.bucketNameRevoked)
+		if bucket == nil {
+			return nil
+		}
+
+		for _, k := range keys {
+			if bucket.Get(k) != nil {
+				found = true
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return found, err
+}
+
+func dbAddIssuedCert(conf *config, rec *issuedCert) error {
+	val, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode issued certificate record: %v", err)
+	}
+
+	err = dbUpdate(conf, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameIssued)
+		if err != nil {
+			return err
+		}
+
+		// Key records by sequence number so they're stored in order of issuance
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+
+		return bucket.Put(key, val)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record issued certificate in database: %v", err)
+	}
+
+	return nil
+}
+
+func dbQueryIssuedCerts(conf *config, q ledgerQuery) ([]*issuedCert, error) {
+	recs := make([]*issuedCert, 0)
+
+	err := dbView(conf, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conf.bucketNameIssued)
+		if bucket == nil {
+			return nil
+		}
+
+		// Walk the ledger newest first
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil && len(recs) < q.limit; k, v = c.Prev() {
+			var rec issuedCert
+			err := json.Unmarshal(v, &rec)
+			if err != nil {
+				return fmt.Errorf("issued certificate record in db corrupted for key %x: %v", k, err)
+			}
+			// SSH certificates issued without serials used to be recorded with a serial of 0
+			if rec.Serial == "0" && rec.Type != issuedTLS {
+				rec.Serial = ""
+			}
+			if q.match(&rec) {
+				recs = append(recs, &rec)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query issued certificates: %v", err)
+	}
+
+	return recs, nil
+}
+
+func dbGetActiveCAKey(conf *config) ([]byte, map[string]time.Time, error) {
+	var fp []byte
+	retired := make(map[string]time.Time)
+
+	err := dbView(conf, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conf.bucketNameKeyring)
+		if bucket == nil {
+			return nil
+		}
+
+		val := bucket.Get([]byte("active"))
+		if val != nil {
+			fp = append([]byte{}, val...)
+		}
+
+		// Keys retired by rotations, and when they were retired
+		val = bucket.Get([]byte("retired"))
+		if val != nil {
+			return json.Unmarshal(val, &retired)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read active ca key from database: %v", err)
+	}
+
+	return fp, retired, nil
+}
+
+func dbSetActiveCAKey(conf *config, fp []byte, retired map[string]time.Time) error {
+	val, err := json.Marshal(retired)
+	if err != nil {
+		return fmt.Errorf("failed to encode retired ca keys: %v", err)
+	}
+
+	err = dbUpdate(conf, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameKeyring)
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put([]byte("active"), fp)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte("retired"), val)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save active ca key to database: %v", err)
+	}
+
+	return nil
+}
+
+func dbClaimPubKey(conf *config, fp, user string) (string, error) {
+	var owner string
+
+	// Look up and claim the pubkey in one transaction so two users can't race for it
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameOwners)
+		if err != nil {
+			return err
+		}
+
+		val := bucket.Get([]byte(fp))
+		if len(val) > 0 {
+			owner = string(val)
+			return nil
+		}
+
+		owner = user
+		return bucket.Put([]byte(fp), []byte(user))
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to check pubkey owner in database: %v", err)
+	}
+
+	return owner, nil
+}
+
+// Pairs of pubkey buckets and the buckets holding their records that are still keyed by MD5 fingerprint
+func legacyFPBuckets(conf *config) [][2][]byte {
+	return [][2][]byte{
+		{conf.bucketNameFP, conf.bucketNameFPMD5},
+		{conf.bucketNameOwners, conf.bucketNameOwnersMD5},
+	}
+}
+
+func dbMoveLegacyFPs(conf *config) (int, error) {
+	moved := 0
+
+	// MD5 fingerprints can't be converted without the pubkey, so move them into their own buckets
+	// where dbRekeyLegacyFP can find them the next time each pubkey is presented
+	err := dbUpdate(conf, func(tx *bolt.Tx) error {
+		for _, names := range legacyFPBuckets(conf) {
+			bucket, err := tx.CreateBucketIfNotExists(names[0])
+			if err != nil {
+				return err
+			}
+
+			var keys [][]byte
+			bucket.ForEach(func(k, v []byte) error {
+				if !bytes.HasPrefix(k, []byte("SHA256:")) {
+					keys = append(keys, append([]byte{}, k...))
+				}
+				return nil
+			})
+			if len(keys) == 0 {
+				continue
+			}
+
+			legacy, err := tx.CreateBucketIfNotExists(names[1])
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				err = legacy.Put(k, append([]byte{}, bucket.Get(k)...))
+				if err != nil {
+					return err
+				}
+				err = bucket.Delete(k)
+				if err != nil {
+					return err
+				}
+				moved++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to migrate md5 fingerprints in database: %v", err)
+	}
+
+	return moved, nil
+}
+
+func dbRekeyLegacyFP(conf *config, legacyFP, fp string) error {
+	// Skip the write transaction for pubkeys that have nothing left to migrate
+	found := false
+	err := dbView(conf, func(tx *bolt.Tx) error {
+		for _, names := range legacyFPBuckets(conf) {
+			legacy := tx.Bucket(names[1])
+			if legacy != nil && legacy.Get([]byte(legacyFP)) != nil {
+				found = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read md5 fingerprint records from database: %v", err)
+	}
+	if !found {
+		return nil
+	}
+
+	err = dbUpdate(conf, func(tx *bolt.Tx) error {
+		for _, names := range legacyFPBuckets(conf) {
+			legacy := tx.Bucket(names[1])
+			if legacy == nil {
+				continue
+			}
+			val := legacy.Get([]byte(legacyFP))
+			if val == nil {
+				continue
+			}
+
+			// Keep any record already made under the SHA256 fingerprint
+			bucket, err := tx.CreateBucketIfNotExists(names[0])
+			if err != nil {
+				return err
+			}
+			if bucket.Get([]byte(fp)) == nil {
+				err = bucket.Put([]byte(fp), append([]byte{}, val...))
+				if err != nil {
+					return err
+				}
+			}
+			err = legacy.Delete([]byte(legacyFP))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate md5 fingerprint %s in database: %v", legacyFP, err)
+	}
+
+	return nil
+}
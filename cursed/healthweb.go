@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+// Signing a probe can mean a request to a remote signer or HSM, so unauthenticated /readyz requests
+// reuse a recent result rather than signing every time
+const signerProbeTTL = 10 * time.Second
+
+var signerProbe struct {
+	at   time.Time
+	conf *config
+	err  error
+	mu   sync.Mutex
+}
+
+type healthCheck struct {
+	Error  string `json:"error,omitempty"`
+	Status string `json:"status"`
+}
+
+type healthReport struct {
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+	Status string                 `json:"status"`
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// We're alive if we can answer at all
+	writeHealth(w, healthReport{Status: "ok"})
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "ready", "")
+
+	// Run each of our dependency checks
+	report := healthReport{
+		Checks: map[string]healthCheck{
+			"db":     newHealthCheck(checkDBReady(conf)),
+			"pwauth": newHealthCheck(checkExecutable(conf.Pwauth)),
+			"signer": newHealthCheck(cachedSignerReady(conf)),
+			"tls_ca": newHealthCheck(checkTLSCAReady(conf)),
+		},
+		Status: "ok",
+	}
+	if _, ok := conf.authorizer.(execAuthorizer); ok {
+		report.Checks["unixgroup"] = newHealthCheck(checkExecutable(conf.Unixgroup))
+	}
+	// The details can include file paths and backend errors, so they only go in our log
+	var failed []string
+	for name, c := range report.Checks {
+		if c.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", name, c.Error))
+			report.Checks[name] = healthCheck{Error: "check failed, see the cursed log", Status: c.Status}
+		}
+	}
+	sort.Strings(failed)
+
+	// Only log failures, so load balancer probes don't flood the logs
+	if len(failed) > 0 {
+		report.Status = "fail"
+		code := http.StatusServiceUnavailable
+		logger.req(un, code, fmt.Sprintf("readiness check failed: %s", strings.Join(failed, ", ")))
+		w.WriteHeader(code)
+	}
+
+	writeHealth(w, report)
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	out, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(out, '\n'))
+}
+
+func newHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Error: err.Error(), Status: "fail"}
+	}
+
+	return healthCheck{Status: "ok"}
+}
+
+func checkDBReady(conf *config) error {
+	return dbView(conf, func(tx *bolt.Tx) error {
+		b := tx.Bucket(conf.bucketNameFP)
+		if b == nil {
+			return fmt.Errorf("bucket not found: %s", conf.bucketNameFP)
+		}
+		return nil
+	})
+}
+
+func cachedSignerReady(conf *config) error {
+	signerProbe.mu.Lock()
+	defer signerProbe.mu.Unlock()
+
+	// A reload brings new signers, so don't reuse a result from the old config
+	if signerProbe.conf != conf || time.Since(signerProbe.at) > signerProbeTTL {
+		signerProbe.err = checkSignerReady(conf)
+		signerProbe.at = time.Now()
+		signerProbe.conf = conf
+	}
+
+	return signerProbe.err
+}
+
+func checkSignerReady(conf *config) error {
+	signers := map[string]ssh.Signer{}
+	signers["user ca"], _ = conf.sshCA.active()
+	if conf.HostSSLCA != "" {
+		signers["host ca"] = conf.sshHostCASigner
+	}
+
+	// Sign and verify a random probe with each CA we issue certificates from
+	probe := make([]byte, 32)
+	_, err := rand.Read(probe)
+	if err != nil {
+		return err
+	}
+	for name, signer := range signers {
+		if signer == nil {
+			return fmt.Errorf("no %s key loaded", name)
+		}
+		sig, err := signer.Sign(rand.Reader, probe)
+		if err != nil {
+			return fmt.Errorf("%s failed to sign probe: %v", name, err)
+		}
+		err = signer.PublicKey().Verify(probe, sig)
+		if err != nil {
+			return fmt.Errorf("%s probe signature invalid: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func checkExecutable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("not executable: %s", path)
+	}
+
+	return nil
+}
+
+func checkTLSCAReady(conf *config) error {
+	if conf.tlsCACert == nil {
+		return fmt.Errorf("tls ca certificate not loaded")
+	}
+
+	now := time.Now()
+	if now.After(conf.tlsCACert.NotAfter) {
+		return fmt.Errorf("tls ca certificate expired at %s", conf.tlsCACert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if now.Before(conf.tlsCACert.NotBefore) {
+		return fmt.Errorf("tls ca certificate not valid until %s", conf.tlsCACert.NotBefore.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
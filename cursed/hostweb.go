@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func sshHostCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "host", "")
+
+	// Load our form parameters into a struct
+	p, err := getJSONParams(w, r, conf)
+	if err != nil {
+		msg := fmt.Sprintf("bad json in request: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, "bad request", code)
+		return
+	}
+
+	// Verify the client certificate was issued by the host identity CA
+	clientCert, err := verifyClientCert(r, conf.tlsHostCAPool)
+	if err != nil {
+		msg := fmt.Sprintf("no valid host certificate provided: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "no-host-cert"})
+		http.Error(w, "not authorized", code)
+		return
+	}
+	un = clientCert.Subject.CommonName
+
+	// Work out which hostnames this host is allowed to be certified for
+	hostnames, err := validateHostnames(conf, clientCert.Subject.CommonName, clientCert.DNSNames, p.Hostnames)
+	if err != nil {
+		msg := fmt.Sprintf("validation failure: %v", err)
+		code := http.StatusForbidden
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Reason: "hostname-not-allowed"})
+		http.Error(w, msg, code)
+		return
+	}
+
+	// Refuse to issue certificates during a lockdown. Hosts have no emergency exemption
+	ls, err := currentLockdown(conf)
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+	if ls.Enabled {
+		msg := fmt.Sprintf("lockdown: certificate issuance is locked down (%s): %s", ls.Source, ls.Reason)
+		code := http.StatusServiceUnavailable
+		logger.req(un, code, msg)
+		http.Error(w, "certificate issuance is locked down", code)
+		return
+	}
+
+	if p.Key == "" {
+		msg := "validation failure: key missing from request"
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+
+	// Set our certificate validity times
+	va := time.Now().Add(-30 * time.Second)
+	vb := time.Now().Add(conf.hostDur)
+
+	// Generate a fingerprint of the received public key for our key_id string
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.Key))
+	if err != nil {
+		msg := "unable to parse authorized key"
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+	fp := ssh.FingerprintSHA256(pk)
+
+	// Make sure the pubkey meets our algorithm and strength requirements
+	err = conf.keyPolicy.check(pk)
+	if err != nil {
+		msg := fmt.Sprintf("pubkey rejected: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+
+	// Refuse to certify revoked host keys
+	revoked, err := pubKeyRevoked(conf, pk)
+	if err != nil {
+		msg := fmt.Sprintf("failed to check pubkey revocation: %v", err)
+		code := http.StatusInternalServerError
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+	if revoked {
+		msg := fmt.Sprintf("pubkey revoked: host[%s] pubkey[%s]", un, fp)
+		code := http.StatusForbidden
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Fingerprint: fp, Reason: "pubkey-revoked"})
+		http.Error(w, "submitted pubkey has been revoked", code)
+		return
+	}
+
+	// Generate our key_id for the certificate
+	kc := keyIDContext{
+		CA:          string(conf.sshHostCAFP),
+		Principals:  hostnames,
+		SSHKey:      fp,
+		Type:        "host",
+		User:        un,
+		ValidBefore: vb.Truncate(time.Second),
+	}
+	keyID, err := kc.format(conf)
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+
+	// Set all of our certificate options
+	cc := certConfig{
+		certType:    ssh.HostCert,
+		keyID:       keyID,
+		principals:  hostnames,
+		requester:   un,
+		validAfter:  va,
+		validBefore: vb,
+	}
+
+	// Sign the public key
+	authorizedKey, err := signPubKey(conf, []byte(p.Key), cc)
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+
+	// Log the request
+	code := http.StatusOK
+	logger.audit(un, code, keyID, auditInfo{Event: eventHostCertIssued, Fingerprint: fp, KeyID: keyID,
+		Principal: strings.Join(hostnames, ",")})
+	conf.webhooks.notify(webhookEvent{Type: eventSSHCertIssued, CertType: "host", Fingerprint: fp, IP: ip,
+		KeyID: keyID, Principal: strings.Join(hostnames, ","), User: un})
+
+	// Return the cert
+	w.Write(authorizedKey)
+}
+
+func validateHostnames(conf *config, cn string, sans, requested []string) ([]string, error) {
+	// Build the list of names the host identity certificate vouches for
+	allowed := make(map[string]bool)
+	names := make([]string, 0, len(sans)+1)
+	for _, name := range append([]string{cn}, sans...) {
+		name = strings.ToLower(name)
+		if name == "" || allowed[name] {
+			continue
+		}
+		allowed[name] = true
+		names = append(names, name)
+	}
+
+	// Default to every name in the identity certificate
+	if len(requested) == 0 {
+		requested = names
+	}
+	if len(requested) == 0 {
+		return nil, fmt.Errorf("no hostnames found in host identity certificate")
+	}
+
+	hostnames := make([]string, 0, len(requested))
+	for _, name := range requested {
+		name = strings.ToLower(name)
+		if !conf.hostRegex.MatchString(name) && !validIP(name) {
+			return nil, fmt.Errorf("hostname is invalid: |%s|", name)
+		}
+		if !allowed[name] {
+			return nil, fmt.Errorf("hostname not present in host identity certificate: %s", name)
+		}
+		hostnames = append(hostnames, name)
+	}
+
+	return hostnames, nil
+}
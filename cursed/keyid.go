@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// keyIDContext holds the request details available to key ID templates. The json tags define the
+// built-in compact JSON key ID format
+type keyIDContext struct {
+	BastionIP   string    `json:"bastion_ip,omitempty"`
+	CA          string    `json:"ca"`
+	Command     string    `json:"cmd,omitempty"`
+	Principals  []string  `json:"principals,omitempty"`
+	SSHKey      string    `json:"key"`
+	SSHKeyMD5   string    `json:"key_md5,omitempty"`
+	Type        string    `json:"type"`
+	User        string    `json:"user"`
+	UserIP      string    `json:"from,omitempty"`
+	ValidBefore time.Time `json:"valid_to"`
+}
+
+// Values in the bracketed key ID format have backslashes and closing brackets escaped with a
+// backslash, so a command like "[ -f x ] sshKey[...]" can't be mistaken for the following fields
+const keyIDField = `((?:[^\\\]]|\\.)*)`
+
+var (
+	keyIDUserRegex = regexp.MustCompile(`^user\[` + keyIDField + `\] from\[` + keyIDField + `\] command\[` + keyIDField +
+		`\] sshKey\[` + keyIDField + `\](?: sshKeyMD5\[` + keyIDField + `\])? ca\[` + keyIDField + `\] valid to\[` + keyIDField + `\]$`)
+	keyIDHostRegex = regexp.MustCompile(`^host\[` + keyIDField + `\] hostnames\[` + keyIDField + `\] sshKey\[` + keyIDField +
+		`\] ca\[` + keyIDField + `\] valid to\[` + keyIDField + `\]$`)
+
+	keyIDEscaper   = strings.NewReplacer(`\`, `\\`, `]`, `\]`)
+	keyIDUnescaper = regexp.MustCompile(`\\(.)`)
+
+	// Matches the key ID in sshd's "Accepted publickey" log lines
+	keyIDLogRegex = regexp.MustCompile(` ID (.*) \(serial \d+\) CA `)
+)
+
+var keyIDFuncs = template.FuncMap{
+	"join": strings.Join,
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func loadKeyIDTemplate(tmpl string) (*template.Template, error) {
+	if tmpl == "" || tmpl == "json" {
+		return nil, nil
+	}
+
+	t, err := template.New("keyid").Funcs(keyIDFuncs).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyidtemplate: %v", err)
+	}
+
+	// Catch references to fields that don't exist now rather than on the first request
+	err = t.Execute(ioutil.Discard, &keyIDContext{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyidtemplate: %v", err)
+	}
+
+	return t, nil
+}
+
+func (kc *keyIDContext) format(conf *config) (string, error) {
+	if conf.KeyIDTemplate == "json" {
+		b, err := json.Marshal(kc)
+		return string(b), err
+	}
+	if conf.keyIDTmpl != nil {
+		var b strings.Builder
+		err := conf.keyIDTmpl.Execute(&b, kc)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate key id: %v", err)
+		}
+		return b.String(), nil
+	}
+
+	// Fall back to our original bracketed format
+	esc := keyIDEscaper.Replace
+	vb := kc.ValidBefore.Format(time.RFC3339)
+	if kc.Type == "host" {
+		return fmt.Sprintf("host[%s] hostnames[%s] sshKey[%s] ca[%s] valid to[%s]",
+			esc(kc.User), esc(strings.Join(kc.Principals, ",")), esc(kc.SSHKey), esc(kc.CA), vb), nil
+	}
+	md5 := ""
+	if kc.SSHKeyMD5 != "" {
+		md5 = fmt.Sprintf(" sshKeyMD5[%s]", esc(kc.SSHKeyMD5))
+	}
+	return fmt.Sprintf("user[%s] from[%s] command[%s] sshKey[%s]%s ca[%s] valid to[%s]",
+		esc(kc.User), esc(kc.UserIP), esc(kc.Command), esc(kc.SSHKey), md5, esc(kc.CA), vb), nil
+}
+
+func parseKeyID(keyID string) (*keyIDContext, error) {
+	keyID = strings.TrimSpace(keyID)
+
+	// Pull the key ID out of sshd log lines
+	if m := keyIDLogRegex.FindStringSubmatch(keyID); m != nil {
+		keyID = m[1]
+	}
+
+	var kc keyIDContext
+	if strings.HasPrefix(keyID, "{") {
+		err := json.Unmarshal([]byte(keyID), &kc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse json key id: %v", err)
+		}
+		return &kc, nil
+	}
+
+	var (
+		vb  string
+		err error
+	)
+	unescape := func(m []string) {
+		for i := range m {
+			m[i] = keyIDUnescaper.ReplaceAllString(m[i], "$1")
+		}
+	}
+	if m := keyIDUserRegex.FindStringSubmatch(keyID); m != nil {
+		unescape(m)
+		kc = keyIDContext{
+			Command:   m[3],
+			CA:        m[6],
+			SSHKey:    m[4],
+			SSHKeyMD5: m[5],
+			Type:      "user",
+			User:      m[1],
+			UserIP:    m[2],
+		}
+		vb = m[7]
+	} else if m := keyIDHostRegex.FindStringSubmatch(keyID); m != nil {
+		unescape(m)
+		kc = keyIDContext{
+			CA:         m[4],
+			Principals: strings.Split(m[2], ","),
+			SSHKey:     m[3],
+			Type:       "host",
+			User:       m[1],
+		}
+		vb = m[5]
+	} else {
+		return nil, fmt.Errorf("unrecognized key id format: %s", keyID)
+	}
+	kc.ValidBefore, err = time.Parse(time.RFC3339, vb)
+	if err != nil {
+		return nil, fmt.Errorf("invalid valid to time in key id: %v", err)
+	}
+
+	return &kc, nil
+}
+
+func keyIDParseCmd(args []string) int {
+	// Parse key IDs from our arguments, or one per line from stdin
+	keyIDs := args
+	if len(keyIDs) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) != "" {
+				keyIDs = append(keyIDs, scanner.Text())
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read key ids: %v\n", err)
+			return 1
+		}
+	}
+
+	rc := 0
+	enc := json.NewEncoder(os.Stdout)
+	for _, keyID := range keyIDs {
+		kc, err := parseKeyID(keyID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			rc = 1
+			continue
+		}
+		enc.Encode(kc)
+	}
+
+	return rc
+}
+
+func runSubcommand(args []string) int {
+	if len(args) >= 2 && args[0] == "keyid" && args[1] == "parse" {
+		return keyIDParseCmd(args[2:])
+	}
+
+	fmt.Fprintln(os.Stderr, "usage: cursed [keyid parse [keyid ...]]")
+	return 2
+}
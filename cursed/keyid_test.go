@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKeyIDContexts() []*keyIDContext {
+	vb := time.Date(2017, 4, 1, 12, 2, 0, 0, time.UTC)
+
+	return []*keyIDContext{
+		{
+			CA:          "SHA256:ca",
+			Command:     "uptime",
+			SSHKey:      "SHA256:key",
+			Type:        "user",
+			User:        "alice",
+			UserIP:      "10.1.2.3",
+			ValidBefore: vb,
+		},
+		{
+			CA:          "SHA256:ca",
+			SSHKey:      "SHA256:key",
+			SSHKeyMD5:   "de:ad:be:ef",
+			Type:        "user",
+			User:        "bob",
+			UserIP:      "10.1.2.4",
+			ValidBefore: vb,
+		},
+		{
+			// Brackets and backslashes in the command must not bleed into the fields after it
+			CA:          "SHA256:ca",
+			Command:     `[ -f /tmp/x ] sshKey[SHA256:forged] ca[SHA256:forged] && echo a\]b`,
+			SSHKey:      "SHA256:key",
+			Type:        "user",
+			User:        "mallory",
+			UserIP:      "10.1.2.5",
+			ValidBefore: vb,
+		},
+		{
+			CA:          "SHA256:ca",
+			Principals:  []string{"web1.example.com", "web1"},
+			SSHKey:      "SHA256:hostkey",
+			Type:        "host",
+			User:        "web1.example.com",
+			ValidBefore: vb,
+		},
+	}
+}
+
+func TestKeyIDRoundTrip(t *testing.T) {
+	for _, tmpl := range []string{"", "json"} {
+		conf := &config{KeyIDTemplate: tmpl}
+		for _, kc := range testKeyIDContexts() {
+			keyID, err := kc.format(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseKeyID(keyID)
+			if err != nil {
+				t.Errorf("parseKeyID(%s): %v", keyID, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, kc) {
+				t.Errorf("parseKeyID(%s):\n got %+v\nwant %+v", keyID, got, kc)
+			}
+		}
+	}
+}
+
+func TestKeyIDEscaping(t *testing.T) {
+	kc := testKeyIDContexts()[2]
+	keyID, err := kc.format(&config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(keyID, `command[[ -f /tmp/x \] sshKey[SHA256:forged\] ca[SHA256:forged\] && echo a\\\]b]`) {
+		t.Errorf("command not escaped in key id: %s", keyID)
+	}
+
+	// Unescaped brackets inside a field are an error, not a guess
+	_, err = parseKeyID("user[alice] from[10.1.2.3] command[ls]] sshKey[SHA256:key] ca[SHA256:ca] valid to[2017-04-01T12:02:00Z]")
+	if err == nil {
+		t.Error("parsed a key id with an unescaped bracket")
+	}
+}
+
+func TestParseKeyIDFromLog(t *testing.T) {
+	line := "Apr  1 12:00:00 web1 sshd[1234]: Accepted publickey for root from 10.0.0.1 port 50000 ssh2: " +
+		"ED25519-CERT SHA256:key ID user[alice] from[10.1.2.3] command[] sshKey[SHA256:key] ca[SHA256:ca] " +
+		"valid to[2017-04-01T12:02:00Z] (serial 42) CA ED25519 SHA256:ca"
+
+	kc, err := parseKeyID(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kc.User != "alice" || kc.UserIP != "10.1.2.3" || kc.Command != "" || kc.CA != "SHA256:ca" {
+		t.Errorf("got %+v", kc)
+	}
+}
+
+func TestParseKeyIDErrors(t *testing.T) {
+	for _, keyID := range []string{
+		"",
+		"alice",
+		`{"user":`,
+		"user[alice] from[10.1.2.3] command[] sshKey[SHA256:key] ca[SHA256:ca] valid to[yesterday]",
+	} {
+		if _, err := parseKeyID(keyID); err == nil {
+			t.Errorf("parseKeyID(%q) succeeded", keyID)
+		}
+	}
+}
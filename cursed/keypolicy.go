@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type keyPolicy struct {
+	curves     map[string]bool
+	minRSABits int
+	types      map[string]bool
+}
+
+// Key type names, matching jinx's keygentype setting where possible
+var sshKeyTypes = map[string]string{
+	ssh.KeyAlgoDSA:        "dsa",
+	ssh.KeyAlgoECDSA256:   "ecdsa",
+	ssh.KeyAlgoECDSA384:   "ecdsa",
+	ssh.KeyAlgoECDSA521:   "ecdsa",
+	ssh.KeyAlgoED25519:    "ed25519",
+	ssh.KeyAlgoRSA:        "rsa",
+	ssh.KeyAlgoSKECDSA256: "sk-ecdsa",
+	ssh.KeyAlgoSKED25519:  "sk-ed25519",
+}
+
+// Curve names, matching our sslkeycurve setting
+var sshKeyCurves = map[string]string{
+	ssh.KeyAlgoECDSA256:   "p256",
+	ssh.KeyAlgoECDSA384:   "p384",
+	ssh.KeyAlgoECDSA521:   "p521",
+	ssh.KeyAlgoSKECDSA256: "p256",
+}
+
+func newKeyPolicy(types, curves []string, minRSABits int) (*keyPolicy, error) {
+	kp := &keyPolicy{
+		curves:     make(map[string]bool),
+		minRSABits: minRSABits,
+		types:      make(map[string]bool),
+	}
+
+	known := make(map[string]bool)
+	for _, t := range sshKeyTypes {
+		known[t] = true
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if !known[t] {
+			return nil, fmt.Errorf("invalid key type in allowedkeytypes: %s", t)
+		}
+		kp.types[t] = true
+	}
+
+	for _, c := range curves {
+		c = strings.ToLower(c)
+		if c != "p256" && c != "p384" && c != "p521" {
+			return nil, fmt.Errorf("invalid curve in allowedcurves: %s", c)
+		}
+		kp.curves[c] = true
+	}
+
+	if minRSABits < 0 {
+		return nil, fmt.Errorf("minrsabits must not be negative: %d", minRSABits)
+	}
+
+	return kp, nil
+}
+
+func (kp *keyPolicy) check(pk ssh.PublicKey) error {
+	keyType, ok := sshKeyTypes[pk.Type()]
+	if !ok {
+		return fmt.Errorf("unsupported key type: %s", pk.Type())
+	}
+	if !kp.types[keyType] {
+		return fmt.Errorf("key type %s is not permitted", keyType)
+	}
+
+	if curve, ok := sshKeyCurves[pk.Type()]; ok && !kp.curves[curve] {
+		return fmt.Errorf("ecdsa curve %s is not permitted", curve)
+	}
+
+	if keyType == "rsa" {
+		cpk, ok := pk.(ssh.CryptoPublicKey)
+		if !ok {
+			return fmt.Errorf("unable to read rsa key size")
+		}
+		rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("unable to read rsa key size")
+		}
+		if bits := rsaKey.N.BitLen(); bits < kp.minRSABits {
+			return fmt.Errorf("rsa key size %d bits is below the minimum of %d", bits, kp.minRSABits)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testPubKeys returns a pubkey of each algorithm in sshKeyTypes, plus a 1024 bit RSA key
+func testPubKeys(t *testing.T) map[string]ssh.PublicKey {
+	t.Helper()
+
+	keys := make(map[string]ssh.PublicKey)
+	add := func(name string, key interface{}) {
+		pk, err := ssh.NewPublicKey(key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		keys[name] = pk
+	}
+
+	for _, bits := range []int{1024, 2048} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := ssh.KeyAlgoRSA
+		if bits == 1024 {
+			name += "-1024"
+		}
+		add(name, &key.PublicKey)
+	}
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk, err := ssh.NewPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[pk.Type()] = pk
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(ssh.KeyAlgoED25519, edKey)
+
+	// Only the key's type matters to the policy, so the DSA parameters needn't be real
+	add(ssh.KeyAlgoDSA, &dsa.PublicKey{
+		Parameters: dsa.Parameters{P: big.NewInt(23), Q: big.NewInt(11), G: big.NewInt(4)},
+		Y:          big.NewInt(8),
+	})
+
+	// Security keys can't be generated here, so build their wire format by hand
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, wire := range map[string][]byte{
+		ssh.KeyAlgoSKED25519: ssh.Marshal(struct {
+			Name        string
+			Key         []byte
+			Application string
+		}{ssh.KeyAlgoSKED25519, edKey, "ssh:"}),
+		ssh.KeyAlgoSKECDSA256: ssh.Marshal(struct {
+			Name        string
+			Curve       string
+			Key         []byte
+			Application string
+		}{ssh.KeyAlgoSKECDSA256, "nistp256", elliptic.Marshal(elliptic.P256(), ecKey.X, ecKey.Y), "ssh:"}),
+	} {
+		pk, err := ssh.ParsePublicKey(wire)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		keys[name] = pk
+	}
+
+	return keys
+}
+
+func TestKeyPolicyCheck(t *testing.T) {
+	keys := testPubKeys(t)
+	allTypes := []string{"dsa", "ecdsa", "ed25519", "rsa", "sk-ecdsa", "sk-ed25519"}
+	allCurves := []string{"p256", "p384", "p521"}
+
+	// Every key type we know about passes a policy allowing everything
+	kp, err := newKeyPolicy(allTypes, allCurves, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for algo := range sshKeyTypes {
+		if err := kp.check(keys[algo]); err != nil {
+			t.Errorf("%s: %v", algo, err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		types      []string
+		curves     []string
+		minRSABits int
+		key        string
+		err        string
+	}{
+		{"type allowed", []string{"ed25519"}, nil, 0, ssh.KeyAlgoED25519, ""},
+		{"type not allowed", []string{"ed25519"}, nil, 0, ssh.KeyAlgoRSA, "key type rsa is not permitted"},
+		{"dsa not allowed", []string{"rsa", "ecdsa", "ed25519"}, allCurves, 0, ssh.KeyAlgoDSA, "key type dsa is not permitted"},
+		{"types are case insensitive", []string{"ED25519"}, nil, 0, ssh.KeyAlgoED25519, ""},
+		{"security key not allowed", []string{"ed25519"}, nil, 0, ssh.KeyAlgoSKED25519, "key type sk-ed25519 is not permitted"},
+		{"security key allowed", []string{"sk-ed25519"}, nil, 0, ssh.KeyAlgoSKED25519, ""},
+		{"curve allowed", []string{"ecdsa"}, []string{"p384"}, 0, ssh.KeyAlgoECDSA384, ""},
+		{"curve not allowed", []string{"ecdsa"}, []string{"p384"}, 0, ssh.KeyAlgoECDSA256, "ecdsa curve p256 is not permitted"},
+		{"p521 not allowed", []string{"ecdsa"}, []string{"p256", "p384"}, 0, ssh.KeyAlgoECDSA521, "ecdsa curve p521 is not permitted"},
+		{"no curves allowed", []string{"ecdsa"}, nil, 0, ssh.KeyAlgoECDSA256, "ecdsa curve p256 is not permitted"},
+		{"security key curve", []string{"sk-ecdsa"}, []string{"p384"}, 0, ssh.KeyAlgoSKECDSA256, "ecdsa curve p256 is not permitted"},
+		{"rsa at minimum", []string{"rsa"}, nil, 2048, ssh.KeyAlgoRSA, ""},
+		{"rsa below minimum", []string{"rsa"}, nil, 2048, ssh.KeyAlgoRSA + "-1024", "rsa key size 1024 bits is below the minimum of 2048"},
+		{"rsa above minimum", []string{"rsa"}, nil, 1024, ssh.KeyAlgoRSA, ""},
+	}
+	for _, tt := range tests {
+		kp, err := newKeyPolicy(tt.types, tt.curves, tt.minRSABits)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		err = kp.check(keys[tt.key])
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestKeyPolicyConfig(t *testing.T) {
+	tests := []struct {
+		types      []string
+		curves     []string
+		minRSABits int
+		ok         bool
+	}{
+		{[]string{"ed25519", "rsa"}, []string{"p256"}, 2048, true},
+		{[]string{"SK-ECDSA"}, []string{"P384"}, 0, true},
+		{nil, nil, 0, true},
+		{[]string{"ed448"}, nil, 0, false},
+		{[]string{"ssh-ed25519"}, nil, 0, false},
+		{[]string{"ecdsa"}, []string{"p192"}, 0, false},
+		{[]string{"ecdsa"}, []string{"nistp256"}, 0, false},
+		{[]string{"rsa"}, nil, -1, false},
+	}
+	for _, tt := range tests {
+		_, err := newKeyPolicy(tt.types, tt.curves, tt.minRSABits)
+		if (err == nil) != tt.ok {
+			t.Errorf("newKeyPolicy(%v, %v, %d): got error %v, want ok %v", tt.types, tt.curves, tt.minRSABits, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How often we check for scheduled rotations and retired keys we no longer trust
+const caScheduleInterval = 10 * time.Second
+
+// SSH CA key states
+const (
+	caKeyActive  = "active"
+	caKeyNext    = "next"
+	caKeyRetired = "retired"
+)
+
+type caKey struct {
+	Activate string
+	Backend  string
+	File     string
+	State    string
+
+	activateAt time.Time
+	fp         []byte
+	retiredAt  time.Time
+	signer     ssh.Signer
+}
+
+type caKeyring struct {
+	keys      []*caKey
+	mu        sync.Mutex
+	onRotate  func(*caKeyring)
+	published string
+	retainFor time.Duration
+	rotateMu  sync.Mutex
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+type caKeyInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	State       string `json:"state"`
+	Activate    string `json:"activate,omitempty"`
+	PublicKey   string `json:"public_key"`
+}
+
+func loadSSHCAKeyring(conf *config) (*caKeyring, error) {
+	// Without a keyring config, our single CA key is the active key
+	keys := conf.CAKeys
+	if len(keys) == 0 {
+		keys = []*caKey{{File: conf.CAKeyFile, State: caKeyActive}}
+	}
+
+	kr := &caKeyring{keys: keys, stop: make(chan struct{})}
+	active := 0
+	for _, k := range kr.keys {
+		if k == nil || k.File == "" {
+			return nil, fmt.Errorf("cakeys entries require a file")
+		}
+
+		switch k.State {
+		case caKeyActive:
+			active++
+		case caKeyNext, caKeyRetired:
+		default:
+			return nil, fmt.Errorf("invalid state for ca key %s: %q (must be active, next or retired)", k.File, k.State)
+		}
+
+		if k.Activate != "" {
+			if k.State != caKeyNext {
+				return nil, fmt.Errorf("activate time set on ca key %s, but it is not the next key", k.File)
+			}
+			t, err := time.Parse(time.RFC3339, k.Activate)
+			if err != nil {
+				return nil, fmt.Errorf("invalid activate time for ca key %s (must be RFC3339): %v", k.File, err)
+			}
+			k.activateAt = t
+		}
+
+		var err error
+		backend := k.Backend
+		if backend == "" {
+			backend = conf.CABackend
+		}
+		k.signer, k.fp, err = loadSSHCA(conf, k.File, backend)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if active != 1 {
+		return nil, fmt.Errorf("exactly one active ca key is required, found %d", active)
+	}
+
+	return kr, nil
+}
+
+func (kr *caKeyring) active() (ssh.Signer, []byte) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for _, k := range kr.keys {
+		if k.State == caKeyActive {
+			return k.signer, k.fp
+		}
+	}
+
+	// This should never happen, as we always have exactly one active key
+	return nil, nil
+}
+
+func (kr *caKeyring) activeFP() []byte {
+	_, fp := kr.active()
+
+	return fp
+}
+
+func (kr *caKeyring) rotate(fp string) ([]byte, error) {
+	kr.mu.Lock()
+	next, err := kr.nextKey(fp)
+	if err == nil {
+		kr.promote(next, time.Now())
+	}
+	kr.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Save and publish the change once we've let go of the keyring
+	kr.rotated()
+
+	return next.fp, nil
+}
+
+// nextKey picks the requested next key, or the first next key if none was requested. kr.mu must be held
+func (kr *caKeyring) nextKey(fp string) (*caKey, error) {
+	for _, k := range kr.keys {
+		if k.State != caKeyNext {
+			continue
+		}
+		if fp == "" || string(k.fp) == fp {
+			return k, nil
+		}
+	}
+	if fp != "" {
+		return nil, fmt.Errorf("no next ca key with fingerprint %s", fp)
+	}
+
+	return nil, fmt.Errorf("no next ca key available to rotate to")
+}
+
+// promote makes k the active key and retires the current active key. kr.mu must be held
+func (kr *caKeyring) promote(k *caKey, now time.Time) {
+	for _, old := range kr.keys {
+		if old.State == caKeyActive {
+			old.State = caKeyRetired
+			old.retiredAt = now
+		}
+	}
+	k.State = caKeyActive
+	k.activateAt = time.Time{}
+}
+
+// rotated saves and publishes the keyring after a change. kr.mu must not be held
+func (kr *caKeyring) rotated() {
+	// Run one at a time, so an older state is never saved over a newer one
+	kr.rotateMu.Lock()
+	defer kr.rotateMu.Unlock()
+
+	if kr.onRotate != nil {
+		kr.onRotate(kr)
+	}
+
+	kr.mu.Lock()
+	kr.published = kr.trustedFPs(time.Now())
+	kr.mu.Unlock()
+}
+
+// tick switches over to any next key whose activation time has arrived, and republishes our
+// trusted keys when a retired key is no longer trusted
+func (kr *caKeyring) tick(now time.Time) {
+	kr.mu.Lock()
+	changed := false
+	for _, k := range kr.keys {
+		if k.State == caKeyNext && !k.activateAt.IsZero() && !now.Before(k.activateAt) {
+			kr.promote(k, now)
+			changed = true
+			log.Printf("scheduled ssh ca key rotation: %s is now the active key", k.fp)
+		}
+	}
+	if kr.trustedFPs(now) != kr.published {
+		changed = true
+	}
+	kr.mu.Unlock()
+
+	if changed {
+		kr.rotated()
+	}
+}
+
+func (kr *caKeyring) schedule() {
+	ticker := time.NewTicker(caScheduleInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				kr.tick(now)
+			case <-kr.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopSchedule stops scheduled rotations, and waits for any in progress to be saved
+func (kr *caKeyring) stopSchedule() {
+	kr.stopOnce.Do(func() { close(kr.stop) })
+	kr.rotateMu.Lock()
+	kr.rotateMu.Unlock()
+}
+
+func (kr *caKeyring) restoreActive(fp []byte) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	// Re-apply a rotation made since the config was written, so a restart doesn't undo it
+	for _, k := range kr.keys {
+		if !bytes.Equal(k.fp, fp) {
+			continue
+		}
+		switch k.State {
+		case caKeyActive:
+			return nil
+		case caKeyNext:
+			kr.promote(k, time.Now())
+			return nil
+		default:
+			return fmt.Errorf("previously active ca key %s is now retired in config, using configured active key", fp)
+		}
+	}
+
+	return nil
+}
+
+func (kr *caKeyring) restoreRetired(retired map[string]time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	// Keep trusting keys retired by a rotation since the config was written
+	for _, k := range kr.keys {
+		if t, ok := retired[string(k.fp)]; ok && k.State == caKeyRetired {
+			k.retiredAt = t
+		}
+	}
+	kr.published = kr.trustedFPs(time.Now())
+}
+
+func (kr *caKeyring) retired() map[string]time.Time {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	retired := make(map[string]time.Time)
+	for _, k := range kr.keys {
+		if k.State == caKeyRetired && !k.retiredAt.IsZero() {
+			retired[string(k.fp)] = k.retiredAt
+		}
+	}
+
+	return retired
+}
+
+func (kr *caKeyring) info() []caKeyInfo {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	keys := make([]caKeyInfo, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		ki := caKeyInfo{
+			Fingerprint: string(k.fp),
+			State:       k.State,
+			PublicKey:   string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(k.signer.PublicKey()))),
+		}
+		if !k.activateAt.IsZero() {
+			ki.Activate = k.activateAt.Format(time.RFC3339)
+		}
+		keys = append(keys, ki)
+	}
+
+	return keys
+}
+
+// isTrusted reports whether destination servers should trust k. kr.mu must be held
+func (kr *caKeyring) isTrusted(k *caKey, now time.Time) bool {
+	// Both the active key and any upcoming keys should be trusted, as well as recently retired
+	// keys until the last certificates they signed have expired
+	switch k.State {
+	case caKeyActive, caKeyNext:
+		return true
+	case caKeyRetired:
+		return !k.retiredAt.IsZero() && now.Before(k.retiredAt.Add(kr.retainFor))
+	}
+
+	return false
+}
+
+// trustedFPs lists the fingerprints of our trusted keys, to tell when they change. kr.mu must be held
+func (kr *caKeyring) trustedFPs(now time.Time) string {
+	var fps []string
+	for _, k := range kr.keys {
+		if kr.isTrusted(k, now) {
+			fps = append(fps, string(k.fp))
+		}
+	}
+
+	return strings.Join(fps, ",")
+}
+
+func (kr *caKeyring) trusted() []ssh.PublicKey {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	var keys []ssh.PublicKey
+	now := time.Now()
+	for _, k := range kr.keys {
+		if kr.isTrusted(k, now) {
+			keys = append(keys, k.signer.PublicKey())
+		}
+	}
+
+	return keys
+}
+
+func (kr *caKeyring) all() map[string]ssh.PublicKey {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	keys := make(map[string]ssh.PublicKey)
+	for _, k := range kr.keys {
+		keys[string(k.fp)] = k.signer.PublicKey()
+	}
+
+	return keys
+}
+
+func writeTrustedCAFile(conf *config) error {
+	if conf.TrustedCAFile == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, pk := range conf.sshCA.trusted() {
+		buf.Write(ssh.MarshalAuthorizedKey(pk))
+	}
+
+	err := ioutil.WriteFile(conf.TrustedCAFile, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write trusted ca file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestKeyring(t *testing.T, states ...string) *caKeyring {
+	t.Helper()
+
+	kr := &caKeyring{stop: make(chan struct{})}
+	for _, state := range states {
+		signer := newTestSigner(t)
+		kr.keys = append(kr.keys, &caKey{
+			State:  state,
+			fp:     []byte(ssh.FingerprintSHA256(signer.PublicKey())),
+			signer: signer,
+		})
+	}
+
+	return kr
+}
+
+func TestKeyringRetiredKeysStayTrusted(t *testing.T) {
+	kr := newTestKeyring(t, caKeyActive, caKeyNext, caKeyRetired)
+	kr.retainFor = time.Hour
+	old, next := kr.keys[0], kr.keys[1]
+
+	var rotations int
+	kr.onRotate = func(kr *caKeyring) {
+		// Called without the keyring locked, so it can read the keyring
+		_, fp := kr.active()
+		if string(fp) != string(next.fp) {
+			t.Errorf("onRotate saw active key %s, want %s", fp, next.fp)
+		}
+		rotations++
+	}
+
+	fp, err := kr.rotate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fp) != string(next.fp) || rotations != 1 {
+		t.Fatalf("rotated to %s with %d onRotate calls, want %s with 1", fp, rotations, next.fp)
+	}
+
+	// The old active key is still trusted, but the key retired in the config isn't
+	if got := len(kr.trusted()); got != 2 {
+		t.Fatalf("got %d trusted keys after rotation, want 2", got)
+	}
+	if _, ok := kr.retired()[string(old.fp)]; !ok {
+		t.Fatal("old active key not recorded as retired")
+	}
+
+	// Once its certificates have expired, the next tick drops it and republishes our keys
+	kr.tick(time.Now())
+	if rotations != 1 {
+		t.Fatalf("tick republished unchanged keys")
+	}
+	old.retiredAt = time.Now().Add(-2 * time.Hour)
+	kr.tick(time.Now())
+	if rotations != 2 {
+		t.Fatalf("tick didn't republish after a retired key expired")
+	}
+	if got := len(kr.trusted()); got != 1 {
+		t.Fatalf("got %d trusted keys after the retired key expired, want 1", got)
+	}
+}
+
+func TestKeyringScheduledRotation(t *testing.T) {
+	kr := newTestKeyring(t, caKeyActive, caKeyNext)
+	kr.retainFor = time.Hour
+	next := kr.keys[1]
+	next.activateAt = time.Now().Add(time.Minute)
+
+	rotations := 0
+	kr.onRotate = func(*caKeyring) { rotations++ }
+	kr.published = kr.trustedFPs(time.Now())
+
+	kr.tick(time.Now())
+	if next.State != caKeyNext || rotations != 0 {
+		t.Fatalf("next key activated early")
+	}
+	kr.tick(time.Now().Add(2 * time.Minute))
+	if next.State != caKeyActive || rotations != 1 {
+		t.Fatalf("next key not activated on schedule: %s", next.State)
+	}
+}
+
+func TestKeyringRestoreRetired(t *testing.T) {
+	kr := newTestKeyring(t, caKeyRetired, caKeyActive)
+	kr.retainFor = time.Hour
+
+	// A key retired by a rotation before a restart is still trusted for the rest of its time
+	kr.restoreRetired(map[string]time.Time{string(kr.keys[0].fp): time.Now().Add(-time.Minute)})
+	if got := len(kr.trusted()); got != 2 {
+		t.Fatalf("got %d trusted keys, want 2", got)
+	}
+	kr.restoreRetired(map[string]time.Time{string(kr.keys[0].fp): time.Now().Add(-2 * time.Hour)})
+	if got := len(kr.trusted()); got != 1 {
+		t.Fatalf("got %d trusted keys, want 1", got)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func keyringHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "keyring", "")
+
+	// Only admins may view or rotate the keyring
+	user, err := adminUser(conf, r)
+	if user != "" {
+		un = user
+	}
+	if err != nil {
+		msg := fmt.Sprintf("authorization failure: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "not-admin"})
+		http.Error(w, "not authorized", code)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		// Load our form parameters into a struct
+		p, err := getJSONParams(w, r, conf)
+		if err != nil {
+			msg := fmt.Sprintf("bad json in request: %v", err)
+			code := http.StatusBadRequest
+			logger.req(un, code, msg)
+			http.Error(w, "bad request", code)
+			return
+		}
+
+		// Rotate to the requested next key
+		fp, err := conf.sshCA.rotate(p.Fingerprint)
+		if err != nil {
+			msg := fmt.Sprintf("rotation failure: %v", err)
+			code := http.StatusBadRequest
+			logger.req(un, code, msg)
+			http.Error(w, msg, code)
+			return
+		}
+		logger.audit(un, http.StatusOK, fmt.Sprintf("rotated ssh ca: %s is now the active key", fp),
+			auditInfo{Event: eventCARotated, Fingerprint: string(fp), Level: "warning"})
+	default:
+		msg := fmt.Sprintf("invalid method: %s", r.Method)
+		code := http.StatusMethodNotAllowed
+		logger.req(un, code, msg)
+		http.Error(w, "method not allowed", code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conf.sshCA.info())
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH KRL format constants, as documented in PROTOCOL.krl
+const (
+	krlMagic         = 0x5353484b524c0a00
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList = 0x20
+	krlSectionCertKeyID      = 0x23
+)
+
+type revocation struct {
+	Type      string    `json:"type"`
+	CA        string    `json:"ca,omitempty"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason,omitempty"`
+	RevokedBy string    `json:"revoked_by"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// Revocation types
+const (
+	revokeSerial      = "serial"
+	revokeKeyID       = "keyid"
+	revokeFingerprint = "fingerprint"
+	revokeKey         = "key"
+)
+
+func (rev *revocation) dbKey() []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s", rev.Type, rev.CA, rev.Value))
+}
+
+func knownSSHCAs(conf *config) map[string]ssh.PublicKey {
+	cas := conf.sshCA.all()
+	if conf.sshHostCASigner != nil {
+		cas[string(conf.sshHostCAFP)] = conf.sshHostCASigner.PublicKey()
+	}
+
+	return cas
+}
+
+func newRevocation(conf *config, p httpParams, admin string) (*revocation, error) {
+	rev := &revocation{
+		Reason:    p.Reason,
+		RevokedBy: admin,
+		RevokedAt: time.Now().UTC(),
+	}
+
+	// Serial and key ID revocations are specific to a CA, defaulting to the user CA
+	ca := p.CA
+	if ca == "" {
+		ca = string(conf.sshCA.activeFP())
+	}
+
+	set := 0
+	if p.Serial != 0 {
+		if _, ok := knownSSHCAs(conf)[ca]; !ok {
+			return nil, fmt.Errorf("unknown ca: %s", ca)
+		}
+		rev.Type, rev.CA, rev.Value = revokeSerial, ca, strconv.FormatUint(p.Serial, 10)
+		set++
+	}
+	if p.KeyID != "" {
+		if _, ok := knownSSHCAs(conf)[ca]; !ok {
+			return nil, fmt.Errorf("unknown ca: %s", ca)
+		}
+		rev.Type, rev.CA, rev.Value = revokeKeyID, ca, p.KeyID
+		set++
+	}
+	if p.Fingerprint != "" {
+		if !strings.HasPrefix(p.Fingerprint, "SHA256:") {
+			return nil, fmt.Errorf("only SHA256 fingerprints can be revoked: %s", p.Fingerprint)
+		}
+		hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(p.Fingerprint, "SHA256:"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid fingerprint: %s", p.Fingerprint)
+		}
+		rev.Type, rev.Value = revokeFingerprint, p.Fingerprint
+		set++
+	}
+	if p.Key != "" {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.Key))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse authorized key: %v", err)
+		}
+		rev.Type, rev.Value = revokeKey, base64.StdEncoding.EncodeToString(pk.Marshal())
+		set++
+	}
+
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of serial, key_id, fingerprint or key is required")
+	}
+
+	return rev, nil
+}
+
+func pubKeyRevoked(conf *config, pk ssh.PublicKey) (bool, error) {
+	keys := [][]byte{
+		(&revocation{Type: revokeFingerprint, Value: ssh.FingerprintSHA256(pk)}).dbKey(),
+		(&revocation{Type: revokeKey, Value: base64.StdEncoding.EncodeToString(pk.Marshal())}).dbKey(),
+	}
+
+	return dbHasRevocation(conf, keys)
+}
+
+func genKRL(conf *config) ([]byte, error) {
+	revs, version, err := dbGetRevocations(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort our revocations into their KRL sections
+	serials := make(map[string][]uint64)
+	keyIDs := make(map[string][]string)
+	var keys [][]byte
+	var hashes [][]byte
+	for _, rev := range revs {
+		switch rev.Type {
+		case revokeSerial:
+			serial, err := strconv.ParseUint(rev.Value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("revoked serial in db corrupted: %v", err)
+			}
+			serials[rev.CA] = append(serials[rev.CA], serial)
+		case revokeKeyID:
+			keyIDs[rev.CA] = append(keyIDs[rev.CA], rev.Value)
+		case revokeFingerprint:
+			hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(rev.Value, "SHA256:"))
+			if err != nil {
+				return nil, fmt.Errorf("revoked fingerprint in db corrupted: %v", err)
+			}
+			hashes = append(hashes, hash)
+		case revokeKey:
+			blob, err := base64.StdEncoding.DecodeString(rev.Value)
+			if err != nil {
+				return nil, fmt.Errorf("revoked key in db corrupted: %v", err)
+			}
+			keys = append(keys, blob)
+		}
+	}
+
+	var krl bytes.Buffer
+
+	// Write the KRL header
+	krlUint64(&krl, krlMagic)
+	krlUint32(&krl, krlFormatVersion)
+	krlUint64(&krl, version)
+	krlUint64(&krl, uint64(time.Now().Unix()))
+	krlUint64(&krl, 0) // flags
+	krlString(&krl, nil)
+	krlString(&krl, []byte("curse"))
+
+	// Write a certificate section for each CA with revocations
+	cas := knownSSHCAs(conf)
+	caFPs := make([]string, 0, len(cas))
+	for fp := range cas {
+		if len(serials[fp]) > 0 || len(keyIDs[fp]) > 0 {
+			caFPs = append(caFPs, fp)
+		}
+	}
+	sort.Strings(caFPs)
+	for _, fp := range caFPs {
+		var section bytes.Buffer
+		krlString(&section, cas[fp].Marshal())
+		krlString(&section, nil)
+
+		if list := serials[fp]; len(list) > 0 {
+			sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+			var sub bytes.Buffer
+			for i, serial := range list {
+				if i > 0 && serial == list[i-1] {
+					continue
+				}
+				krlUint64(&sub, serial)
+			}
+			section.WriteByte(krlSectionCertSerialList)
+			krlString(&section, sub.Bytes())
+		}
+
+		if list := keyIDs[fp]; len(list) > 0 {
+			sort.Strings(list)
+			var sub bytes.Buffer
+			for _, keyID := range list {
+				krlString(&sub, []byte(keyID))
+			}
+			section.WriteByte(krlSectionCertKeyID)
+			krlString(&section, sub.Bytes())
+		}
+
+		krl.WriteByte(krlSectionCertificates)
+		krlString(&krl, section.Bytes())
+	}
+
+	// Write our explicitly revoked keys
+	if len(keys) > 0 {
+		var section bytes.Buffer
+		for _, blob := range keys {
+			krlString(&section, blob)
+		}
+		krl.WriteByte(krlSectionExplicitKey)
+		krlString(&krl, section.Bytes())
+	}
+
+	// Write our revoked key fingerprints, which sshd requires in sorted order
+	if len(hashes) > 0 {
+		sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i], hashes[j]) < 0 })
+		var section bytes.Buffer
+		for i, hash := range hashes {
+			if i > 0 && bytes.Equal(hash, hashes[i-1]) {
+				continue
+			}
+			krlString(&section, hash)
+		}
+		krl.WriteByte(krlSectionFingerprintSHA256)
+		krlString(&krl, section.Bytes())
+	}
+
+	return krl.Bytes(), nil
+}
+
+func krlUint32(buf *bytes.Buffer, n uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	buf.Write(b)
+}
+
+func krlUint64(buf *bytes.Buffer, n uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	buf.Write(b)
+}
+
+func krlString(buf *bytes.Buffer, s []byte) {
+	krlUint32(buf, uint32(len(s)))
+	buf.Write(s)
+}
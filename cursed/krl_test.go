@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testRevoke(t *testing.T, conf *config, p httpParams) {
+	t.Helper()
+
+	rev, err := newRevocation(conf, p, "admin")
+	if err != nil {
+		t.Fatalf("newRevocation(%+v): %v", p, err)
+	}
+	err = dbAddRevocation(conf, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testCert(t *testing.T, ca ssh.Signer, serial uint64, keyID string) *ssh.Certificate {
+	t.Helper()
+
+	cert := &ssh.Certificate{
+		CertType:    ssh.UserCert,
+		Key:         newTestSigner(t).PublicKey(),
+		KeyId:       keyID,
+		Serial:      serial,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	err := cert.SignCert(rand.Reader, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// krlReader walks the sections of a KRL, failing the test on truncated data
+type krlReader struct {
+	t   *testing.T
+	buf []byte
+}
+
+func (kr *krlReader) uint32() uint32 {
+	kr.t.Helper()
+	if len(kr.buf) < 4 {
+		kr.t.Fatal("krl truncated")
+	}
+	n := binary.BigEndian.Uint32(kr.buf)
+	kr.buf = kr.buf[4:]
+	return n
+}
+
+func (kr *krlReader) uint64() uint64 {
+	kr.t.Helper()
+	if len(kr.buf) < 8 {
+		kr.t.Fatal("krl truncated")
+	}
+	n := binary.BigEndian.Uint64(kr.buf)
+	kr.buf = kr.buf[8:]
+	return n
+}
+
+func (kr *krlReader) byte() byte {
+	kr.t.Helper()
+	if len(kr.buf) < 1 {
+		kr.t.Fatal("krl truncated")
+	}
+	b := kr.buf[0]
+	kr.buf = kr.buf[1:]
+	return b
+}
+
+func (kr *krlReader) string() []byte {
+	kr.t.Helper()
+	n := int(kr.uint32())
+	if len(kr.buf) < n {
+		kr.t.Fatal("krl truncated")
+	}
+	s := kr.buf[:n]
+	kr.buf = kr.buf[n:]
+	return s
+}
+
+func TestGenKRLEmpty(t *testing.T) {
+	conf := newTestConf(t)
+
+	krl, err := genKRL(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &krlReader{t: t, buf: krl}
+	if r.uint64() != krlMagic {
+		t.Fatal("bad krl magic")
+	}
+	if r.uint32() != krlFormatVersion {
+		t.Fatal("bad krl format version")
+	}
+	if version := r.uint64(); version != 0 {
+		t.Errorf("got krl version %d for an empty list, want 0", version)
+	}
+	r.uint64() // generated date
+	r.uint64() // flags
+	r.string() // reserved
+	if comment := string(r.string()); comment != "curse" {
+		t.Errorf("got comment %q, want curse", comment)
+	}
+	if len(r.buf) != 0 {
+		t.Errorf("empty krl has %d bytes of sections", len(r.buf))
+	}
+}
+
+func TestGenKRLSections(t *testing.T) {
+	conf := newTestConf(t)
+	ca, _ := conf.sshCA.active()
+
+	revokedKey := newTestSigner(t).PublicKey()
+	revokedFP := newTestSigner(t).PublicKey()
+	testRevoke(t, conf, httpParams{Serial: 42})
+	testRevoke(t, conf, httpParams{Serial: 7})
+	testRevoke(t, conf, httpParams{KeyID: "user[alice]"})
+	testRevoke(t, conf, httpParams{Key: string(ssh.MarshalAuthorizedKey(revokedKey))})
+	testRevoke(t, conf, httpParams{Fingerprint: ssh.FingerprintSHA256(revokedFP)})
+
+	krl, err := genKRL(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &krlReader{t: t, buf: krl}
+	r.uint64()
+	r.uint32()
+	if version := r.uint64(); version != 5 {
+		t.Errorf("got krl version %d after 5 revocations, want 5", version)
+	}
+	r.uint64()
+	r.uint64()
+	r.string()
+	r.string()
+
+	// Sections come in a fixed order: certificates, explicit keys, then SHA256 fingerprints
+	if typ := r.byte(); typ != krlSectionCertificates {
+		t.Fatalf("got section %d, want certificates", typ)
+	}
+	certs := &krlReader{t: t, buf: r.string()}
+	if !bytes.Equal(certs.string(), ca.PublicKey().Marshal()) {
+		t.Error("certificate section is not for the user ca")
+	}
+	certs.string() // reserved
+	if typ := certs.byte(); typ != krlSectionCertSerialList {
+		t.Fatalf("got certificate subsection %d, want serial list", typ)
+	}
+	serials := &krlReader{t: t, buf: certs.string()}
+	if a, b := serials.uint64(), serials.uint64(); a != 7 || b != 42 || len(serials.buf) != 0 {
+		t.Errorf("got serials %d, %d, want sorted 7, 42", a, b)
+	}
+	if typ := certs.byte(); typ != krlSectionCertKeyID {
+		t.Fatalf("got certificate subsection %d, want key ids", typ)
+	}
+	keyIDs := &krlReader{t: t, buf: certs.string()}
+	if keyID := string(keyIDs.string()); keyID != "user[alice]" {
+		t.Errorf("got revoked key id %q", keyID)
+	}
+
+	if typ := r.byte(); typ != krlSectionExplicitKey {
+		t.Fatalf("got section %d, want explicit keys", typ)
+	}
+	keys := &krlReader{t: t, buf: r.string()}
+	if !bytes.Equal(keys.string(), revokedKey.Marshal()) {
+		t.Error("explicit key section doesn't hold the revoked key")
+	}
+
+	if typ := r.byte(); typ != krlSectionFingerprintSHA256 {
+		t.Fatalf("got section %d, want sha256 fingerprints", typ)
+	}
+	hashes := &krlReader{t: t, buf: r.string()}
+	want, _ := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(ssh.FingerprintSHA256(revokedFP), "SHA256:"))
+	if !bytes.Equal(hashes.string(), want) {
+		t.Error("fingerprint section doesn't hold the revoked fingerprint")
+	}
+
+	if len(r.buf) != 0 {
+		t.Errorf("%d trailing bytes after the last section", len(r.buf))
+	}
+}
+
+func TestGenKRLWithSSHKeygen(t *testing.T) {
+	keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+
+	conf := newTestConf(t)
+	ca, _ := conf.sshCA.active()
+
+	revokedKey := newTestSigner(t).PublicKey()
+	revokedFP := newTestSigner(t).PublicKey()
+	testRevoke(t, conf, httpParams{Serial: 42})
+	testRevoke(t, conf, httpParams{KeyID: "user[mallory]"})
+	testRevoke(t, conf, httpParams{Key: string(ssh.MarshalAuthorizedKey(revokedKey))})
+	testRevoke(t, conf, httpParams{Fingerprint: ssh.FingerprintSHA256(revokedFP)})
+
+	krl, err := genKRL(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := testTempDir(t)
+	krlFile := filepath.Join(dir, "revoked.krl")
+	err = ioutil.WriteFile(krlFile, krl, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		revoked bool
+	}{
+		{"revoked serial", testCert(t, ca, 42, "user[alice]"), true},
+		{"revoked key id", testCert(t, ca, 43, "user[mallory]"), true},
+		{"good cert", testCert(t, ca, 44, "user[alice]"), false},
+		{"revoked key", revokedKey, true},
+		{"revoked fingerprint", revokedFP, true},
+		{"good key", newTestSigner(t).PublicKey(), false},
+	}
+	for _, tt := range tests {
+		keyFile := filepath.Join(dir, strings.Replace(tt.name, " ", "-", -1)+".pub")
+		err = ioutil.WriteFile(keyFile, ssh.MarshalAuthorizedKey(tt.key), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// ssh-keygen exits non-zero when any of the keys it's given are revoked
+		out, err := exec.Command(keygen, "-Q", "-f", krlFile, keyFile).CombinedOutput()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatal(err)
+		}
+		revoked := strings.Contains(string(out), "REVOKED")
+		if revoked != tt.revoked || (err != nil) != tt.revoked {
+			t.Errorf("%s: ssh-keygen said %q, want revoked %v", tt.name, bytes.TrimSpace(out), tt.revoked)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type issuedCert struct {
+	Type        string    `json:"type"`
+	Serial      string    `json:"serial,omitempty"`
+	KeyID       string    `json:"key_id"`
+	Principals  []string  `json:"principals"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	CA          string    `json:"ca"`
+	Fingerprint string    `json:"fingerprint"`
+	Requester   string    `json:"requester"`
+	BastionIP   string    `json:"bastion_ip,omitempty"`
+	UserIP      string    `json:"user_ip,omitempty"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// Certificate types recorded in the ledger
+const (
+	issuedSSHUser = "ssh-user"
+	issuedSSHHost = "ssh-host"
+	issuedTLS     = "tls"
+)
+
+type ledgerQuery struct {
+	limit     int
+	principal string
+	serial    string
+	since     time.Time
+	certType  string
+	until     time.Time
+	user      string
+}
+
+func parseLedgerQuery(v url.Values) (ledgerQuery, error) {
+	var err error
+	q := ledgerQuery{
+		limit:     1000,
+		principal: v.Get("principal"),
+		serial:    v.Get("serial"),
+		certType:  v.Get("type"),
+		user:      v.Get("user"),
+	}
+
+	if s := v.Get("since"); s != "" {
+		q.since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("invalid since time (must be RFC3339): %s", s)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		q.until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("invalid until time (must be RFC3339): %s", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		q.limit, err = strconv.Atoi(s)
+		if err != nil || q.limit < 1 {
+			return q, fmt.Errorf("invalid limit: %s", s)
+		}
+	}
+
+	return q, nil
+}
+
+func (q ledgerQuery) match(rec *issuedCert) bool {
+	if q.user != "" && rec.Requester != q.user {
+		return false
+	}
+	if q.serial != "" && rec.Serial != q.serial {
+		return false
+	}
+	if q.certType != "" && rec.Type != q.certType {
+		return false
+	}
+	if !q.since.IsZero() && rec.IssuedAt.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && rec.IssuedAt.After(q.until) {
+		return false
+	}
+	if q.principal != "" {
+		found := false
+		for _, p := range rec.Principals {
+			if p == q.principal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
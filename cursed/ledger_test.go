@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseLedgerQuery(t *testing.T) {
+	q, err := parseLedgerQuery(url.Values{
+		"limit":     {"5"},
+		"principal": {"root"},
+		"serial":    {"42"},
+		"since":     {"2017-04-01T00:00:00Z"},
+		"type":      {"ssh-user"},
+		"until":     {"2017-04-02T00:00:00Z"},
+		"user":      {"alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.limit != 5 || q.principal != "root" || q.serial != "42" || q.certType != "ssh-user" || q.user != "alice" ||
+		!q.since.Equal(time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)) || !q.until.Equal(time.Date(2017, 4, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got query %+v", q)
+	}
+
+	if q, _ := parseLedgerQuery(url.Values{}); q.limit != 1000 {
+		t.Errorf("got default limit %d", q.limit)
+	}
+
+	for _, v := range []url.Values{
+		{"since": {"yesterday"}},
+		{"until": {"2017-04-01"}},
+		{"limit": {"0"}},
+		{"limit": {"lots"}},
+	} {
+		if _, err := parseLedgerQuery(v); err == nil {
+			t.Errorf("parseLedgerQuery(%v) succeeded", v)
+		}
+	}
+}
+
+func TestLedgerQueryFilters(t *testing.T) {
+	conf := newTestConf(t)
+	day := time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)
+	for _, rec := range []*issuedCert{
+		{Type: issuedSSHUser, Serial: "1", Principals: []string{"root"}, Requester: "alice", IssuedAt: day},
+		{Type: issuedSSHUser, Serial: "2", Principals: []string{"www"}, Requester: "bob", IssuedAt: day.Add(time.Hour)},
+		{Type: issuedSSHHost, Serial: "3", Principals: []string{"web1", "web1.example.com"}, Requester: "web1", IssuedAt: day.Add(2 * time.Hour)},
+		{Type: issuedTLS, Serial: "12345", Principals: []string{"alice"}, Requester: "alice", IssuedAt: day.Add(3 * time.Hour)},
+		// Certificates issued without serials, the old way and the new
+		{Type: issuedSSHUser, Serial: "0", Principals: []string{"root"}, Requester: "carol", IssuedAt: day.Add(4 * time.Hour)},
+		{Type: issuedSSHUser, Principals: []string{"root"}, Requester: "carol", IssuedAt: day.Add(5 * time.Hour)},
+	} {
+		err := dbAddIssuedCert(conf, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    ledgerQuery
+		want []string
+	}{
+		{"everything", ledgerQuery{}, []string{"carol", "carol", "alice", "web1", "bob", "alice"}},
+		{"limit", ledgerQuery{limit: 2}, []string{"carol", "carol"}},
+		{"user", ledgerQuery{user: "alice"}, []string{"alice", "alice"}},
+		{"principal", ledgerQuery{principal: "root"}, []string{"carol", "carol", "alice"}},
+		{"any principal", ledgerQuery{principal: "web1.example.com"}, []string{"web1"}},
+		{"type", ledgerQuery{certType: issuedSSHHost}, []string{"web1"}},
+		{"serial", ledgerQuery{serial: "2"}, []string{"bob"}},
+		{"serial zero", ledgerQuery{serial: "0"}, nil},
+		{"tls serial", ledgerQuery{serial: "12345"}, []string{"alice"}},
+		{"since", ledgerQuery{since: day.Add(3 * time.Hour)}, []string{"carol", "carol", "alice"}},
+		{"until", ledgerQuery{until: day.Add(time.Hour)}, []string{"bob", "alice"}},
+		{"range", ledgerQuery{since: day.Add(time.Hour), until: day.Add(2 * time.Hour)}, []string{"web1", "bob"}},
+		{"combined", ledgerQuery{principal: "root", user: "alice", until: day}, []string{"alice"}},
+		{"no match", ledgerQuery{user: "mallory"}, nil},
+	}
+	for _, tt := range tests {
+		if tt.q.limit == 0 {
+			tt.q.limit = 1000
+		}
+		recs, err := dbQueryIssuedCerts(conf, tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rec := range recs {
+			got = append(got, rec.Requester)
+			if rec.Serial == "0" {
+				t.Errorf("%s: record returned with a serial of 0", tt.name)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLedgerRecordsSerials(t *testing.T) {
+	conf := newTestConf(t)
+	key := string(ssh.MarshalAuthorizedKey(newTestSigner(t).PublicKey()))
+	cc := certConfig{
+		certType:    ssh.UserCert,
+		principals:  []string{"root"},
+		requester:   "alice",
+		validAfter:  time.Now(),
+		validBefore: time.Now().Add(time.Minute),
+	}
+
+	for _, serials := range []bool{false, true} {
+		conf.SSHSerial = serials
+		_, err := signPubKey(conf, []byte(key), cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recs, err := dbQueryIssuedCerts(conf, ledgerQuery{limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].Serial != "1" || recs[1].Serial != "" {
+		t.Errorf("got records %+v, want serial 1 then no serial", recs)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func ledgerHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "certs", "")
+
+	// Any user may query the ledger, but only admins may see other users' certificates
+	user, err := adminUser(conf, r)
+	if user == "" {
+		msg := fmt.Sprintf("authorization failure: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "no-client-cert"})
+		http.Error(w, "not authorized", code)
+		return
+	}
+	un = user
+	isAdmin := err == nil
+
+	q, err := parseLedgerQuery(r.URL.Query())
+	if err != nil {
+		msg := fmt.Sprintf("validation failure: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+	if !isAdmin {
+		if q.user != "" && q.user != user {
+			msg := fmt.Sprintf("non-admin query for another user's certificates: %s", q.user)
+			code := http.StatusForbidden
+			logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Reason: "not-admin"})
+			http.Error(w, "not authorized", code)
+			return
+		}
+		q.user = user
+	}
+
+	recs, err := dbQueryIssuedCerts(conf, q)
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+
+	// Log the request
+	code := http.StatusOK
+	logger.req(un, code, fmt.Sprintf("query %s returned %d records", r.URL.RawQuery, len(recs)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recs)
+}
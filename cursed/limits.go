@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type principalLimit struct {
+	MaxDuration        int
+	Extensions         []string
+	RequireApproval    bool
+	RequireSecurityKey bool
+	VerifyRequired     bool
+
+	exts    map[string]string
+	maxDur  time.Duration
+	hasExts bool
+}
+
+func loadPrincipalLimits(limits map[string]*principalLimit) error {
+	for principal, l := range limits {
+		if l == nil {
+			return fmt.Errorf("empty principallimits entry for principal: %s", principal)
+		}
+		if l.MaxDuration < 0 {
+			return fmt.Errorf("maxduration must not be negative for principal: %s", principal)
+		}
+		l.maxDur = time.Duration(l.MaxDuration) * time.Second
+
+		if l.Extensions != nil {
+			var errSlice []error
+			l.exts, errSlice = validateExtensions(l.Extensions)
+			if len(errSlice) > 0 {
+				return fmt.Errorf("principallimits for %s: %v", principal, errSlice[0])
+			}
+			l.hasExts = true
+		}
+
+		// User verification can only be enforced on security keys
+		if l.VerifyRequired {
+			l.RequireSecurityKey = true
+		}
+	}
+
+	return nil
+}
+
+func checkSecurityKey(conf *config, principal string, pk ssh.PublicKey) (bool, error) {
+	l, ok := conf.PrincipalLimits[strings.ToLower(principal)]
+	if !ok || !l.RequireSecurityKey {
+		return false, nil
+	}
+
+	if pk.Type() != ssh.KeyAlgoSKED25519 && pk.Type() != ssh.KeyAlgoSKECDSA256 {
+		return false, fmt.Errorf("security key required for principal %s, got %s key", principal, sshKeyTypes[pk.Type()])
+	}
+
+	return l.VerifyRequired, nil
+}
+
+func longestCertLifetime(conf *config) time.Duration {
+	// Principal limits may allow longer certificates than our global maximum
+	longest := conf.maxDur
+	for _, l := range conf.PrincipalLimits {
+		if l.maxDur > longest {
+			longest = l.maxDur
+		}
+	}
+	if conf.breakGlassDur > longest {
+		longest = conf.breakGlassDur
+	}
+
+	return longest
+}
+
+func clampRequest(conf *config, p httpParams, base map[string]string) (time.Duration, map[string]string, []string, error) {
+	var notices []string
+
+	// Find the limits for this principal, falling back on our global limits
+	maxDur := conf.maxDur
+	allowed := make(map[string]string)
+	for name := range base {
+		allowed[name] = ""
+	}
+	for name := range conf.requestableExts {
+		allowed[name] = ""
+	}
+	if l, ok := conf.PrincipalLimits[strings.ToLower(p.RemoteUser)]; ok {
+		if l.maxDur > 0 {
+			maxDur = l.maxDur
+		}
+		if l.hasExts {
+			allowed = l.exts
+		}
+	}
+
+	// Default to our configured duration unless the client asked for something else
+	dur := conf.dur
+	if p.Duration < 0 {
+		return 0, nil, nil, fmt.Errorf("requested duration must not be negative: %d", p.Duration)
+	} else if p.Duration > 0 {
+		dur = time.Duration(p.Duration) * time.Second
+	}
+	if dur > maxDur {
+		notices = append(notices, fmt.Sprintf("requested duration %v reduced to maximum of %v for principal %s",
+			dur, maxDur, p.RemoteUser))
+		dur = maxDur
+	}
+
+	// Default to our base extensions unless the client asked for specific extensions
+	if p.Extensions == nil {
+		return dur, base, notices, nil
+	}
+	requested, errSlice := validateExtensions(p.Extensions)
+	if len(errSlice) > 0 {
+		return 0, nil, nil, errSlice[0]
+	}
+
+	exts := make(map[string]string)
+	var denied []string
+	for name := range requested {
+		if _, ok := allowed[name]; ok {
+			exts[name] = ""
+		} else {
+			denied = append(denied, name)
+		}
+	}
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		notices = append(notices, fmt.Sprintf("extensions not permitted for principal %s: %s",
+			p.RemoteUser, strings.Join(denied, ",")))
+	}
+
+	return dur, exts, notices, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+func getListener(addrPort string) (net.Listener, error) {
+	// Check whether systemd passed us a socket, and that it was meant for us
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return net.Listen("tcp", addrPort)
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, fmt.Errorf("socket activated without any sockets: LISTEN_FDS=%q", os.Getenv("LISTEN_FDS"))
+	}
+	if fds > 1 {
+		log.Printf("socket activated with %d sockets, only the first will be used", fds)
+	}
+
+	// Don't pass the sockets on to any child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(listenFDsStart, "systemd-socket")
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use systemd socket: %v", err)
+	}
+
+	return l, nil
+}
+
+func shutdownOnSignal(server *http.Server, live *confHolder) <-chan struct{} {
+	stopped := make(chan struct{})
+
+	// Stop accepting requests on SIGTERM or SIGINT, and wait for in-flight requests to finish
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-ch
+		log.Printf("received %v, shutting down", sig)
+		conf := live.get()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeout)*time.Second)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("in-flight requests did not finish before shutdowntimeout: %v", err)
+		}
+
+		// Finish any CA key rotation in progress, and save any events we haven't delivered yet
+		conf.sshCA.stopSchedule()
+		conf.webhooks.spoolQueued()
+
+		close(stopped)
+	}()
+
+	return stopped
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// lockdownError means a certificate was refused because issuance is locked down, as opposed to
+// the lockdown state being unreadable
+type lockdownError struct{ error }
+
+type lockdownState struct {
+	By      string     `json:"by,omitempty"`
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Source  string     `json:"source,omitempty"`
+}
+
+func currentLockdown(conf *config) (*lockdownState, error) {
+	// The kill-switch file works even when the admin endpoint or database don't. Only a missing file
+	// means we aren't locked down, anything else fails closed like the database does
+	if conf.LockdownFile != "" {
+		fi, err := os.Stat(conf.LockdownFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to check lockdown file: %v", err)
+		}
+		if err == nil {
+			reason, _ := ioutil.ReadFile(conf.LockdownFile)
+			since := fi.ModTime().UTC()
+			return &lockdownState{
+				Enabled: true,
+				Reason:  strings.TrimSpace(string(reason)),
+				Since:   &since,
+				Source:  "file",
+			}, nil
+		}
+	}
+
+	return dbGetLockdown(conf)
+}
+
+func checkLockdown(conf *config, user string) error {
+	ls, err := currentLockdown(conf)
+	if err != nil {
+		// Fail closed if we can't tell whether we're locked down
+		return err
+	}
+	if !ls.Enabled {
+		return nil
+	}
+
+	// The emergency group may still get certificates
+	for _, u := range conf.EmergencyUsers {
+		if u == user {
+			return nil
+		}
+	}
+	if len(conf.EmergencyGroups) > 0 && checkGroups(conf, user, conf.EmergencyGroups) == nil {
+		return nil
+	}
+
+	return &lockdownError{fmt.Errorf("certificate issuance is locked down (%s): %s", ls.Source, ls.Reason)}
+}
+
+func checkBreakGlass(conf *config, user, principal string) error {
+	allowed := false
+	for _, u := range conf.BreakGlassUsers {
+		if u == user {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("user %s is not permitted to break glass", user)
+	}
+
+	for _, p := range conf.BreakGlassPrincipals {
+		if p == principal {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("principal %s is not a break-glass principal", principal)
+}
+
+func dbGetLockdown(conf *config) (*lockdownState, error) {
+	ls := &lockdownState{}
+
+	err := dbView(conf, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conf.bucketNameLockdown)
+		if bucket == nil {
+			return nil
+		}
+
+		val := bucket.Get([]byte("state"))
+		if val == nil {
+			return nil
+		}
+
+		return json.Unmarshal(val, ls)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockdown state from database: %v", err)
+	}
+	if ls.Enabled {
+		ls.Source = "admin"
+	}
+
+	return ls, nil
+}
+
+func dbSetLockdown(conf *config, ls *lockdownState) error {
+	val, err := json.Marshal(ls)
+	if err != nil {
+		return fmt.Errorf("failed to encode lockdown state: %v", err)
+	}
+
+	err = dbUpdate(conf, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(conf.bucketNameLockdown)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte("state"), val)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save lockdown state in database: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckLockdown(t *testing.T) {
+	conf := newTestConf(t)
+	conf.EmergencyUsers = []string{"carol"}
+	conf.EmergencyGroups = []string{"oncall"}
+	conf.authorizer = testAuthorizer{members: map[string][]string{"oncall": {"dave"}}}
+	conf.LockdownFile = filepath.Join(testTempDir(t), "lockdown")
+
+	// Neither the file nor the database say we're locked down
+	if err := checkLockdown(conf, "bob"); err != nil {
+		t.Fatalf("got %v without a lockdown", err)
+	}
+
+	lockedOut := func(source string) {
+		t.Helper()
+
+		err := checkLockdown(conf, "bob")
+		if _, ok := err.(*lockdownError); !ok || !strings.Contains(err.Error(), "("+source+"): incident 42") {
+			t.Errorf("got %v, want a %s lockdown", err, source)
+		}
+		for _, user := range []string{"carol", "dave"} {
+			if err := checkLockdown(conf, user); err != nil {
+				t.Errorf("emergency user %s: %v", user, err)
+			}
+		}
+	}
+
+	err := dbSetLockdown(conf, &lockdownState{Enabled: true, Reason: "incident 42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockedOut("admin")
+
+	// The emergency group doesn't help when group lookups fail
+	conf.authorizer = testAuthorizer{down: true}
+	if _, ok := checkLockdown(conf, "dave").(*lockdownError); !ok {
+		t.Error("emergency group member let through with the authorizer down")
+	}
+	conf.authorizer = testAuthorizer{members: map[string][]string{"oncall": {"dave"}}}
+
+	// The kill-switch file takes precedence over the database
+	err = dbSetLockdown(conf, &lockdownState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(conf.LockdownFile, []byte("incident 42\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockedOut("file")
+}
+
+func TestCheckLockdownFailsClosed(t *testing.T) {
+	conf := newTestConf(t)
+	conf.EmergencyUsers = []string{"carol"}
+
+	// A lockdown file we can't check isn't taken to mean we're unlocked, even for emergency users
+	notDir := filepath.Join(testTempDir(t), "file")
+	err := ioutil.WriteFile(notDir, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.LockdownFile = filepath.Join(notDir, "lockdown")
+	for _, user := range []string{"bob", "carol"} {
+		err := checkLockdown(conf, user)
+		if err == nil {
+			t.Fatalf("%s: unreadable lockdown file treated as unlocked", user)
+		}
+		if _, ok := err.(*lockdownError); ok {
+			t.Errorf("%s: unreadable lockdown file reported as a lockdown: %v", user, err)
+		}
+	}
+
+	// Likewise for the database
+	conf.LockdownFile = ""
+	conf.db.Close()
+	if err := checkLockdown(conf, "carol"); err == nil {
+		t.Error("unreadable database treated as unlocked")
+	}
+}
+
+func TestCheckBreakGlass(t *testing.T) {
+	conf := &config{
+		BreakGlassPrincipals: []string{"root", "admin"},
+		BreakGlassUsers:      []string{"alice", "bob"},
+	}
+
+	tests := []struct {
+		user      string
+		principal string
+		err       string
+	}{
+		{"alice", "root", ""},
+		{"bob", "admin", ""},
+		{"mallory", "root", "user mallory is not permitted to break glass"},
+		{"alice", "www", "principal www is not a break-glass principal"},
+		{"", "root", "not permitted to break glass"},
+		{"alice", "", "is not a break-glass principal"},
+	}
+	for _, tt := range tests {
+		err := checkBreakGlass(conf, tt.user, tt.principal)
+		if tt.err == "" && err != nil {
+			t.Errorf("checkBreakGlass(%s, %s): %v", tt.user, tt.principal, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("checkBreakGlass(%s, %s): got error %v, want %q", tt.user, tt.principal, err, tt.err)
+		}
+	}
+
+	// Nobody breaks glass unless it's configured
+	if err := checkBreakGlass(&config{}, "alice", "root"); err == nil {
+		t.Error("break glass allowed with no break-glass users")
+	}
+}
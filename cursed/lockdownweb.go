@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func lockdownHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "lockdown", "")
+
+	// Only admins may view or change the lockdown state
+	user, err := adminUser(conf, r)
+	if user != "" {
+		un = user
+	}
+	if err != nil {
+		msg := fmt.Sprintf("authorization failure: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "not-admin"})
+		http.Error(w, "not authorized", code)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		// Load our form parameters into a struct
+		p, err := getJSONParams(w, r, conf)
+		if err != nil {
+			msg := fmt.Sprintf("bad json in request: %v", err)
+			code := http.StatusBadRequest
+			logger.req(un, code, msg)
+			http.Error(w, "bad request", code)
+			return
+		}
+
+		// Lock down issuance
+		now := time.Now().UTC()
+		err = dbSetLockdown(conf, &lockdownState{By: user, Enabled: true, Reason: p.Reason, Since: &now})
+		if err != nil {
+			code := http.StatusInternalServerError
+			logger.req(un, code, err.Error())
+			http.Error(w, "server error", code)
+			return
+		}
+		logger.audit(un, http.StatusOK, fmt.Sprintf("CRITICAL lockdown enabled: reason[%s]", p.Reason),
+			auditInfo{Event: eventLockdown, Level: "critical", Reason: "enabled"})
+	case http.MethodDelete:
+		// The kill-switch file has to be removed by hand
+		ls, err := currentLockdown(conf)
+		if err == nil && ls.Source == "file" {
+			msg := fmt.Sprintf("lockdown file %s is present and must be removed", conf.LockdownFile)
+			code := http.StatusConflict
+			logger.req(un, code, msg)
+			http.Error(w, msg, code)
+			return
+		}
+
+		// Lift the lockdown
+		err = dbSetLockdown(conf, &lockdownState{})
+		if err != nil {
+			code := http.StatusInternalServerError
+			logger.req(un, code, err.Error())
+			http.Error(w, "server error", code)
+			return
+		}
+		logger.audit(un, http.StatusOK, "CRITICAL lockdown lifted", auditInfo{Event: eventLockdown, Level: "critical",
+			Reason: "lifted"})
+	default:
+		msg := fmt.Sprintf("invalid method: %s", r.Method)
+		code := http.StatusMethodNotAllowed
+		logger.req(un, code, msg)
+		http.Error(w, "method not allowed", code)
+		return
+	}
+
+	ls, err := currentLockdown(conf)
+	if err != nil {
+		code := http.StatusInternalServerError
+		logger.req(un, code, err.Error())
+		http.Error(w, "server error", code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ls)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 )
 
 type logTmpl struct {
@@ -12,13 +13,59 @@ type logTmpl struct {
 	rip     string
 }
 
+// auditInfo holds the details of a request worth recording as typed audit fields. Event and Reason
+// are fixed names chosen by the handler, and Level overrides the level implied by the status code
+type auditInfo struct {
+	Command     string
+	Event       string
+	Fingerprint string
+	KeyID       string
+	Level       string
+	Principal   string
+	Reason      string
+}
+
 func (t *logTmpl) req(user string, code int, msg string) {
+	t.audit(user, code, msg, auditInfo{})
+}
+
+func (t *logTmpl) audit(user string, code int, msg string, ai auditInfo) {
 	// ip - ip of bastion server making request
 	// reqType should be ssh or tls, depending on the handler logging this request
 	// code - http status code in response
 	// msg - message to be logged
 	// rip - user's remote IP from bastion connection
 
+	// Count the request
+	t.conf.metrics.incRequest(t.reqType, code, ai.Reason)
+
+	// Write structured events to our audit log sinks if we have any
+	if t.conf.audit != nil {
+		if ai.Event == "" {
+			ai.Event = eventRequest
+		}
+		if ai.Level == "" {
+			ai.Level = auditLevel(code)
+		}
+		t.conf.audit.write(&auditEvent{
+			Code:        code,
+			Command:     ai.Command,
+			Event:       ai.Event,
+			Fingerprint: ai.Fingerprint,
+			Handler:     t.reqType,
+			IP:          t.ip,
+			KeyID:       ai.KeyID,
+			Level:       ai.Level,
+			Msg:         msg,
+			Principal:   ai.Principal,
+			Reason:      ai.Reason,
+			Time:        time.Now().UTC(),
+			User:        user,
+			UserIP:      t.rip,
+		})
+		return
+	}
+
 	line := fmt.Sprintf("%s %s %s %d %s %s", t.ip, t.reqType, user, code, msg, t.rip)
 
 	if t.conf.LogTimestamp {
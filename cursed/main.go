@@ -2,11 +2,14 @@ package main
 
 import (
 	"crypto/ecdsa"
+	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
+	"text/template"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -16,87 +19,172 @@ import (
 )
 
 type config struct {
+	aliases             *principalAliases
+	approvalTimeout     time.Duration
+	audit               *auditLogger
 	authTimeout         time.Duration
+	authorizer          groupAuthorizer
+	bastionLimiter      *rateLimiter
+	breakGlassDur       time.Duration
+	bucketNameApprovals []byte
 	bucketNameFP        []byte
+	bucketNameFPMD5     []byte
+	bucketNameIssued    []byte
+	bucketNameKeyring   []byte
+	bucketNameLockdown  []byte
+	bucketNameOwners    []byte
+	bucketNameOwnersMD5 []byte
+	bucketNameRevoked   []byte
 	bucketNameSSHSerial []byte
 	bucketNameTLSSerial []byte
+	caPass              *passphrase
+	challenges          *challengeStore
 	db                  *bolt.DB
 	dur                 time.Duration
+	execSlots           chan struct{}
+	execWait            time.Duration
 	exts                map[string]string
+	hostDur             time.Duration
+	hostRegex           *regexp.Regexp
+	ipLimiter           *rateLimiter
 	keyLifeSpan         time.Duration
-	principalMap        map[string]string
-	sshCAFP             []byte
-	sshCASigner         ssh.Signer
+	keyIDTmpl           *template.Template
+	keyPolicy           *keyPolicy
+	maxDur              time.Duration
+	metrics             *metrics
+	policy              *aclPolicy
+	rawLogSinks         string
+	rawWebhooks         string
+	requestableExts     map[string]string
+	sshCA               *caKeyring
+	sshHostCAFP         []byte
+	sshHostCASigner     ssh.Signer
+	tlsCABundle         []byte
 	tlsDur              time.Duration
 	tlsCACert           *x509.Certificate
 	tlsCAKey            *ecdsa.PrivateKey
+	tlsCert             tls.Certificate
+	tlsConf             *tls.Config
+	tlsHostCAPool       *x509.CertPool
+	tlsKeyPass          *passphrase
+	tlsUserCAPool       *x509.CertPool
+	userLimiter         *rateLimiter
 	userRegex           *regexp.Regexp
-
-	Addr             string
-	AuthTimeout      int
-	CAKeyFile        string
-	DBFile           string
-	Duration         int
-	Extensions       []string
-	ForceCmd         bool
-	ForceUserMatch   bool
-	KeyAgeCritical   bool
-	LogTimestamp     bool
-	MaxKeyAge        int
-	Port             int
-	PrincipalAliases string
-	Pwauth           string
-	RequireClientIP  bool
-	SSHSerial        bool
-	SSLCA            string
-	SSLCADuration    int
-	SSLCert          string
-	SSLCertHostname  string
-	SSLKey           string
-	SSLKeyCurve      string
-	SSLDuration      int
-	Unixgroup        string
+	webhooks            *webhookNotifier
+
+	Addr                 string
+	Admins               []string
+	AllowedCurves        []string
+	AllowedKeyTypes      []string
+	ApprovalTimeout      int
+	Approvers            []string
+	AuthTimeout          int
+	Authorizer           string
+	BreakGlassDuration   int
+	BreakGlassPrincipals []string
+	BreakGlassUsers      []string
+	CAAgentSocket        string
+	CABackend            string
+	CAKeys               []*caKey
+	CAPassphrase         string
+	CAKeyFile            string
+	CARemoteTimeout      int
+	CARemoteToken        string
+	CARemoteURL          string
+	ChallengeTTL         int
+	DBFile               string
+	Duration             int
+	EmergencyGroups      []string
+	EmergencyUsers       []string
+	ExecConcurrency      int
+	ExecQueueTimeout     int
+	Extensions           []string
+	ForceCmd             bool
+	ForceUserMatch       bool
+	HostCAKeyFile        string
+	HostDuration         int
+	HostSSLCA            string
+	KeyAgeCritical       bool
+	KeyIDTemplate        string
+	LegacyFingerprints   bool
+	LockdownFile         string
+	LogSinks             []*logSink
+	LogTimestamp         bool
+	MaxDuration          int
+	MaxKeyAge            int
+	MaxRequestBytes      int64
+	MetricsAddr          string
+	MinRSABits           int
+	PolicyFile           string
+	Port                 int
+	PrincipalAliases     string
+	PrincipalLimits      map[string]*principalLimit
+	Pwauth               string
+	RateLimitBastion     int
+	RateLimitBurst       int
+	RateLimitIP          int
+	RateLimitUser        int
+	RequestableExts      []string `mapstructure:"requestableextensions"`
+	RequireClientIP      bool
+	RequireKeyProof      bool
+	SSHSerial            bool
+	SSLCA                string
+	SSLCADuration        int
+	SSLCert              string
+	SSLCertHostname      string
+	SSLKey               string
+	SSLKeyCurve          string
+	SSLKeyPassphrase     string
+	SSLDuration          int
+	ShutdownTimeout      int
+	TrustedCAFile        string
+	Unixgroup            string
+	WebhookRetries       int
+	WebhookSpoolDir      string
+	Webhooks             []*webhook
 }
 
 func main() {
+	// Run a helper subcommand instead of the daemon if one was given
+	if len(os.Args) > 1 {
+		os.Exit(runSubcommand(os.Args[1:]))
+	}
+
 	// Process/load our config options
 	conf, err := getConf()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Convert our cert validity duration and pubkey lifespan from int to time.Duration
-	conf.dur = time.Duration(conf.Duration) * time.Second
-	if conf.MaxKeyAge < 0 {
-		// Negative MaxKeyAge means unlimited age keys, set lifespan to 100 years
-		conf.keyLifeSpan = 100 * 365 * 24 * time.Hour
-	} else {
-		conf.keyLifeSpan = time.Duration(conf.MaxKeyAge) * 24 * time.Hour
+	// Set up our rate limiters and cap the number of auth helpers running at once
+	conf.ipLimiter = newRateLimiter(conf.RateLimitIP, conf.RateLimitBurst)
+	conf.userLimiter = newRateLimiter(conf.RateLimitUser, conf.RateLimitBurst)
+	conf.bastionLimiter = newRateLimiter(conf.RateLimitBastion, conf.RateLimitBurst)
+	if conf.ExecConcurrency > 0 {
+		conf.execSlots = make(chan struct{}, conf.ExecConcurrency)
 	}
+	conf.execWait = time.Duration(conf.ExecQueueTimeout) * time.Second
 
-	// Convert our TLS cert "session" length and pubkey lifespan from int to time.Duration
-	if conf.SSLDuration < 0 {
-		// Negative SSLDuration means unlimited age keys, set lifespan to 100 years
-		conf.tlsDur = 100 * 365 * 24 * time.Hour
-	} else {
-		conf.tlsDur = time.Duration(conf.SSLDuration) * time.Second
-	}
+	// Set up our store of outstanding key proof nonces
+	conf.challenges = newChallengeStore(time.Duration(conf.ChallengeTTL) * time.Second)
 
-	// Convert our auth command timeout to a duration
-	conf.authTimeout = time.Duration(conf.AuthTimeout) * time.Second
+	// Collect metrics if we have somewhere to serve them
+	if conf.MetricsAddr != "" {
+		conf.metrics = newMetrics()
+	}
 
-	// Load the CA key into an ssh.Signer
-	conf.sshCASigner, conf.sshCAFP, err = loadSSHCA(conf)
+	// Set up our structured audit log sinks, and reopen their files when asked
+	conf.audit, err = newAuditLogger(conf.LogSinks)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
+	conf.audit.reopenOnSignal()
 
 	// Open our key tracking database file
 	conf.db, err = bolt.Open(conf.DBFile, 0600, nil)
 	if err != nil {
 		log.Fatalf("could not open database file %v", err)
 	}
-	defer conf.db.Close()
 
 	// Initialize/check the PubKey lifecycle database
 	err = dbInitPubKeyBucket(conf)
@@ -104,53 +192,252 @@ func main() {
 		log.Fatalf("could not open database file %v", err)
 	}
 
-	// Check TLS certs
-	ok, err := initTLSCerts(conf)
-	if !ok {
-		log.Fatal(err)
+	// Move pubkeys recorded under MD5 fingerprints aside, to be re-keyed to SHA256 as they're seen
+	moved, err := dbMoveLegacyFPs(conf)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	if moved > 0 {
+		log.Printf("moved %d md5 pubkey fingerprint records aside for migration to sha256", moved)
+	}
+
+	// Load our CA keys and TLS certs
+	err = setupConf(conf)
 	if err != nil {
-		log.Printf("%v", err)
+		log.Fatalf("%v", err)
+	}
+	conf.sshCA.schedule()
+
+	// Start delivering event notifications
+	conf.webhooks, err = newWebhookNotifier(conf)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	conf.webhooks.start()
+
+	// Hand our config to the request handlers, and swap in a new one whenever we're sent SIGHUP
+	live := newConfHolder(conf)
+	live.reloadOnSignal()
+
+	// Start our metrics listener
+	serveMetrics(live)
 
 	// Start auth service
 	s := http.NewServeMux()
 
 	// Set our cert service web handler
 	s.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		sshCertHandler(w, r, conf)
+		sshCertHandler(w, r, live.get())
 	})
 
 	// Set our auth service web handler
 	s.HandleFunc("/auth/", func(w http.ResponseWriter, r *http.Request) {
-		tlsCertHandler(w, r, conf)
+		tlsCertHandler(w, r, live.get())
 	})
 
-	// Prepare our TLS settings
+	// Set our health check web handlers
+	s.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		healthHandler(w, r, live.get())
+	})
+	s.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyHandler(w, r, live.get())
+	})
+
+	// Set our lockdown admin web handler
+	s.HandleFunc("/admin/lockdown", func(w http.ResponseWriter, r *http.Request) {
+		lockdownHandler(w, r, live.get())
+	})
+
+	// Set our approval workflow web handler
+	s.HandleFunc("/approvals/", func(w http.ResponseWriter, r *http.Request) {
+		approvalHandler(w, r, live.get())
+	})
+
+	// Set our key proof challenge web handler
+	s.HandleFunc("/challenge/", func(w http.ResponseWriter, r *http.Request) {
+		challengeHandler(w, r, live.get())
+	})
+
+	// Set our public CA distribution web handler
+	s.HandleFunc("/ca/", func(w http.ResponseWriter, r *http.Request) {
+		caBundleHandler(w, r, live.get())
+	})
+
+	// Set our CA keyring admin web handler
+	s.HandleFunc("/admin/keyring", func(w http.ResponseWriter, r *http.Request) {
+		keyringHandler(w, r, live.get())
+	})
+
+	// Set our issued certificate query web handler
+	s.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		ledgerHandler(w, r, live.get())
+	})
+
+	// Set our revocation web handlers
+	s.HandleFunc("/admin/revoke", func(w http.ResponseWriter, r *http.Request) {
+		revokeHandler(w, r, live.get())
+	})
+	s.HandleFunc("/krl", func(w http.ResponseWriter, r *http.Request) {
+		krlHandler(w, r, live.get())
+	})
+
+	// Set our pubkey registration web handler
+	s.HandleFunc("/register/", func(w http.ResponseWriter, r *http.Request) {
+		registerHandler(w, r, live.get())
+	})
+
+	// Set our host cert service web handler
+	s.HandleFunc("/host/", func(w http.ResponseWriter, r *http.Request) {
+		conf := live.get()
+		if conf.HostSSLCA == "" {
+			http.NotFound(w, r)
+			return
+		}
+		sshHostCertHandler(w, r, conf)
+	})
+
+	// Prepare our TLS settings, picking up the TLS material from the current config for each connection
 	addrPort := fmt.Sprintf("%s:%d", conf.Addr, conf.Port) // FIXME update config options if this becomes permanent
-	tlsConf, err := getTLSConfig(conf)
-	if err != nil {
-		log.Fatal(err)
-	}
 	server := &http.Server{
-		Addr:         addrPort,
-		Handler:      s,
-		IdleTimeout:  60 * time.Second,
-		ReadTimeout:  5 * time.Second,
-		TLSConfig:    tlsConf,
+		Addr:        addrPort,
+		Handler:     limitRequests(live, s),
+		IdleTimeout: 60 * time.Second,
+		ReadTimeout: 5 * time.Second,
+		TLSConfig: &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return live.get().tlsConf, nil
+			},
+		},
 		WriteTimeout: 10 * time.Second,
 	}
 
+	// Use the socket systemd passed us if we were socket activated
+	listener, err := getListener(addrPort)
+	if err != nil {
+		log.Fatalf("listener service: %v", err)
+	}
+
+	// Let in-flight requests finish when we're asked to stop
+	stopped := shutdownOnSignal(server, live)
+
 	// Start our listener service
 	if conf.LogTimestamp {
-		log.Printf("Starting HTTPS cert server on %s", addrPort)
+		log.Printf("Starting HTTPS cert server on %s", listener.Addr())
 	} else {
-		fmt.Printf("Starting HTTPS cert server on %s\n", addrPort)
+		fmt.Printf("Starting HTTPS cert server on %s\n", listener.Addr())
 	}
-	err = server.ListenAndServeTLS(conf.SSLCert, conf.SSLKey)
-	if err != nil {
+	err = server.ServeTLS(listener, "", "")
+	if err != http.ErrServerClosed {
 		log.Fatalf("listener service: %v", err)
 	}
+	<-stopped
+
+	// Close the database cleanly now nothing else is using it
+	err = conf.db.Close()
+	if err != nil {
+		log.Fatalf("failed to close database: %v", err)
+	}
+	log.Print("shut down cleanly")
+}
+
+func setupConf(conf *config) error {
+	var err error
+
+	// Convert our cert validity duration and pubkey lifespan from int to time.Duration
+	conf.dur = time.Duration(conf.Duration) * time.Second
+	conf.maxDur = time.Duration(conf.MaxDuration) * time.Second
+	if conf.maxDur < conf.dur {
+		conf.maxDur = conf.dur
+	}
+	if conf.MaxKeyAge < 0 {
+		// Negative MaxKeyAge means unlimited age keys, set lifespan to 100 years
+		conf.keyLifeSpan = 100 * 365 * 24 * time.Hour
+	} else {
+		conf.keyLifeSpan = time.Duration(conf.MaxKeyAge) * 24 * time.Hour
+	}
+
+	// Convert our TLS cert "session" length and pubkey lifespan from int to time.Duration
+	if conf.SSLDuration < 0 {
+		// Negative SSLDuration means unlimited age keys, set lifespan to 100 years
+		conf.tlsDur = 100 * 365 * 24 * time.Hour
+	} else {
+		conf.tlsDur = time.Duration(conf.SSLDuration) * time.Second
+	}
+
+	// Convert our host cert validity duration from days to time.Duration
+	conf.hostDur = time.Duration(conf.HostDuration) * 24 * time.Hour
+
+	// Convert our approval request lifetime to a duration
+	conf.approvalTimeout = time.Duration(conf.ApprovalTimeout) * time.Second
+
+	// Convert our break-glass certificate validity duration
+	conf.breakGlassDur = time.Duration(conf.BreakGlassDuration) * time.Second
+
+	// Convert our auth command timeout to a duration
+	conf.authTimeout = time.Duration(conf.AuthTimeout) * time.Second
+
+	// Load the CA keys into our keyring
+	conf.sshCA, err = loadSSHCAKeyring(conf)
+	if err != nil {
+		return err
+	}
+
+	// Load the host CA key if host certificate signing is enabled
+	if conf.HostSSLCA != "" {
+		conf.sshHostCASigner, conf.sshHostCAFP, err = loadSSHCA(conf, conf.HostCAKeyFile, conf.CABackend)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep trusting retired CA keys until the longest lived certificate they could have signed expires
+	conf.sshCA.retainFor = longestCertLifetime(conf)
+
+	// Pick up any CA key rotation made since our config was last updated
+	activeFP, retired, err := dbGetActiveCAKey(conf)
+	if err != nil {
+		return err
+	}
+	if activeFP != nil {
+		err = conf.sshCA.restoreActive(activeFP)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	conf.sshCA.restoreRetired(retired)
+
+	// Save and publish our CA keys whenever the active key or our trusted keys change
+	conf.sshCA.onRotate = func(kr *caKeyring) {
+		err := dbSetActiveCAKey(conf, kr.activeFP(), kr.retired())
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		err = writeTrustedCAFile(conf)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	err = writeTrustedCAFile(conf)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+
+	// Check TLS certs
+	ok, err := initTLSCerts(conf)
+	if !ok {
+		return err
+	}
+	if err != nil {
+		log.Printf("%v", err)
+	}
+
+	// Prepare our TLS settings
+	conf.tlsConf, err = getTLSConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
 func init() {
@@ -164,26 +451,65 @@ func init() {
 	viper.AddConfigPath(".")
 	viper.ReadInConfig()
 
-	// If a config file is found, read it in.
+	// If a config file is found, read it in. Report it on stderr so subcommand output stays clean
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Printf("Using config file: %s\n", viper.ConfigFileUsed())
+		fmt.Fprintf(os.Stderr, "Using config file: %s\n", viper.ConfigFileUsed())
 	}
 
 	viper.SetDefault("addr", "127.0.0.1")
-	viper.SetDefault("authtimeout", 30) // 30 second default
+	viper.SetDefault("admins", []string{})
+	viper.SetDefault("allowedcurves", []string{"p256", "p384", "p521"})
+	viper.SetDefault("allowedkeytypes", []string{"ed25519", "ecdsa", "rsa", "sk-ed25519", "sk-ecdsa"})
+	viper.SetDefault("approvaltimeout", 15*60) // 15 minute default
+	viper.SetDefault("approvers", []string{})
+	viper.SetDefault("authorizer", "exec")
+	viper.SetDefault("authtimeout", 30)          // 30 second default
+	viper.SetDefault("breakglassduration", 5*60) // 5 minute default
+	viper.SetDefault("breakglassprincipals", []string{})
+	viper.SetDefault("breakglassusers", []string{})
+	viper.SetDefault("caagentsocket", os.Getenv("SSH_AUTH_SOCK"))
+	viper.SetDefault("cabackend", "file")
 	viper.SetDefault("cakeyfile", "/opt/curse/etc/user_ca")
+	viper.SetDefault("capassphrase", "")
+	viper.SetDefault("caremotetimeout", 10)
+	viper.SetDefault("caremotetoken", "")
+	viper.SetDefault("caremoteurl", "")
+	viper.SetDefault("challengettl", 60) // 60 second default
 	viper.SetDefault("dbfile", "/opt/curse/etc/cursed.db")
 	viper.SetDefault("duration", 2*60) // 2 minute default
+	viper.SetDefault("emergencygroups", []string{})
+	viper.SetDefault("emergencyusers", []string{})
+	viper.SetDefault("execconcurrency", 8)
+	viper.SetDefault("execqueuetimeout", 5) // 5 second default
 	viper.SetDefault("extensions", []string{"permit-pty"})
 	viper.SetDefault("forcecmd", false)
 	viper.SetDefault("forceusermatch", true)
+	viper.SetDefault("hostcakeyfile", "/opt/curse/etc/host_ca")
+	viper.SetDefault("hostduration", 30) // 30 day default
+	viper.SetDefault("hostsslca", "")
 	viper.SetDefault("keyagecritical", false)
+	viper.SetDefault("keyidtemplate", "")
+	viper.SetDefault("legacyfingerprints", true)
+	viper.SetDefault("lockdownfile", "/opt/curse/etc/lockdown")
+	viper.SetDefault("logsinks", []*logSink{})
 	viper.SetDefault("logtimestamp", false)
-	viper.SetDefault("maxkeyage", 90) // 90 day default
+	viper.SetDefault("maxduration", 2*60)        // 2 minute default
+	viper.SetDefault("maxkeyage", 90)            // 90 day default
+	viper.SetDefault("maxrequestbytes", 64*1024) // 64KiB default
+	viper.SetDefault("metricsaddr", "")
+	viper.SetDefault("minrsabits", 2048)
+	viper.SetDefault("policyfile", "")
 	viper.SetDefault("port", 444)
 	viper.SetDefault("principalaliases", "/opt/curse/etc/aliases.conf")
 	viper.SetDefault("pwauth", "/usr/bin/pwauth")
+	viper.SetDefault("ratelimitbastion", 600)
+	viper.SetDefault("ratelimitburst", 10)
+	viper.SetDefault("ratelimitip", 60)
+	viper.SetDefault("ratelimituser", 30)
+	viper.SetDefault("requestableextensions", []string{})
 	viper.SetDefault("requireclientip", true)
+	viper.SetDefault("requirekeyproof", true)
+	viper.SetDefault("shutdowntimeout", 30) // 30 second default
 	viper.SetDefault("sshserial", false)
 	viper.SetDefault("sslca", "/opt/curse/etc/cursed.crt")
 	viper.SetDefault("sslcaduration", 730) // 2 year default
@@ -191,8 +517,13 @@ func init() {
 	viper.SetDefault("sslcerthostname", "localhost")
 	viper.SetDefault("sslkey", "/opt/curse/etc/cursed.key")
 	viper.SetDefault("sslkeycurve", "p384")
+	viper.SetDefault("sslkeypassphrase", "")
 	viper.SetDefault("sslduration", 12*60) // 12 hour default
+	viper.SetDefault("trustedcafile", "")
 	viper.SetDefault("unixgroup", "/opt/curse/sbin/unixgroup")
+	viper.SetDefault("webhookretries", 5)
+	viper.SetDefault("webhookspooldir", "/opt/curse/etc/spool")
+	viper.SetDefault("webhooks", []*webhook{})
 }
 
 func validateExtensions(confExts []string) (map[string]string, []error) {
@@ -214,7 +545,7 @@ func validateExtensions(confExts []string) (map[string]string, []error) {
 			}
 		}
 		if !valid {
-			err := fmt.Errorf("invalid extension in config: %s", confExts[i])
+			err := fmt.Errorf("invalid extension: %s", confExts[i])
 			errSlice = append(errSlice, err)
 		}
 	}
@@ -230,7 +561,15 @@ func getConf() (*config, error) {
 		return nil, fmt.Errorf("unable to read config into struct: %v", err)
 	}
 	// Hardcoding the DB bucket name
+	conf.bucketNameApprovals = []byte("approvals")
 	conf.bucketNameFP = []byte("pubkeybirthdays")
+	conf.bucketNameFPMD5 = []byte("pubkeybirthdays-md5")
+	conf.bucketNameIssued = []byte("issuedcerts")
+	conf.bucketNameKeyring = []byte("sshcakeyring")
+	conf.bucketNameLockdown = []byte("lockdown")
+	conf.bucketNameOwners = []byte("pubkeyowners")
+	conf.bucketNameOwnersMD5 = []byte("pubkeyowners-md5")
+	conf.bucketNameRevoked = []byte("revoked")
 	conf.bucketNameSSHSerial = []byte("sshserial")
 	conf.bucketNameTLSSerial = []byte("certserial")
 
@@ -239,8 +578,51 @@ func getConf() (*config, error) {
 		return nil, fmt.Errorf("sslca, sslkey, and sslcert are required fields")
 	}
 
+	// Every request needs room for a pubkey or CSR
+	if conf.MaxRequestBytes < 4096 {
+		return nil, fmt.Errorf("maxrequestbytes must be at least 4096: %d", conf.MaxRequestBytes)
+	}
+
+	// Break-glass certificates must be short-lived
+	if conf.BreakGlassDuration < 1 {
+		return nil, fmt.Errorf("breakglassduration must be at least 1 second: %d", conf.BreakGlassDuration)
+	}
+
+	// Approvers need time to respond to approval requests
+	if conf.ApprovalTimeout < 1 {
+		return nil, fmt.Errorf("approvaltimeout must be at least 1 second: %d", conf.ApprovalTimeout)
+	}
+
+	// In-flight requests need time to finish when we shut down
+	if conf.ShutdownTimeout < 1 {
+		return nil, fmt.Errorf("shutdowntimeout must be at least 1 second: %d", conf.ShutdownTimeout)
+	}
+
+	// Key proof nonces need long enough to make the round trip
+	if conf.ChallengeTTL < 1 {
+		return nil, fmt.Errorf("challengettl must be at least 1 second: %d", conf.ChallengeTTL)
+	}
+
+	// Set up where our CA key passphrases come from
+	conf.caPass, err = newPassphrase("ssh ca", conf.CAPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	conf.tlsKeyPass, err = newPassphrase("tls", conf.SSLKeyPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
 	// Expand $HOME into service user's home path
+	conf.CAAgentSocket = expandHome(conf.CAAgentSocket)
 	conf.DBFile = expandHome(conf.DBFile)
+	conf.WebhookSpoolDir = expandHome(conf.WebhookSpoolDir)
+	conf.LockdownFile = expandHome(conf.LockdownFile)
+
+	// Setting up log sinks and webhooks fills in their defaults, so remember them as configured for
+	// reloads to compare against
+	conf.rawLogSinks = rawSettings(conf.LogSinks)
+	conf.rawWebhooks = rawSettings(conf.Webhooks)
 
 	// Check our certificate extensions (permissions) for validity
 	var errSlice []error
@@ -251,15 +633,58 @@ func getConf() (*config, error) {
 		}
 	}
 
+	// Check the extensions clients may request in addition to the defaults
+	conf.requestableExts, errSlice = validateExtensions(conf.RequestableExts)
+	if len(errSlice) > 0 {
+		for _, err := range errSlice {
+			log.Printf("%v", err)
+		}
+	}
+
+	// Check our per-principal request limits
+	err = loadPrincipalLimits(conf.PrincipalLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick how we check users' group membership
+	conf.authorizer, err = newGroupAuthorizer(conf.Authorizer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up our pubkey algorithm and strength policy
+	conf.keyPolicy, err = newKeyPolicy(conf.AllowedKeyTypes, conf.AllowedCurves, conf.MinRSABits)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check our key ID template
+	conf.keyIDTmpl, err = loadKeyIDTemplate(conf.KeyIDTemplate)
+	if err != nil {
+		return nil, err
+	}
+
 	// Load principal aliases file
-	conf.principalMap, err = loadPrincipalMap(conf)
+	conf.aliases, err = loadPrincipalMap(conf)
 	if err != nil {
 		return nil, err
 	}
 
+	// Load the access policy file, which takes the place of the aliases file when set
+	if conf.PolicyFile != "" {
+		conf.policy, err = loadACLPolicy(conf.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Compile our user-matching regex (usernames are limited to 32 characters, must start
 	// with a-z or _, and contain only these characters: a-z, 0-9, - and _
 	conf.userRegex = regexp.MustCompile(`(?i)^[a-z_][a-z0-9_-]{1,31}$`)
 
+	// Compile our hostname-matching regex (dot-separated labels of up to 63 characters each)
+	conf.hostRegex = regexp.MustCompile(`(?i)^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
 	return &conf, nil
 }
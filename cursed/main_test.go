@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+func testTempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "curse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// newTestConf sets up a config with a fresh database and a single active SSH CA key
+func newTestConf(t *testing.T) *config {
+	t.Helper()
+
+	conf := &config{
+		bucketNameApprovals: []byte("approvals"),
+		bucketNameFP:        []byte("pubkeybirthdays"),
+		bucketNameFPMD5:     []byte("pubkeybirthdays-md5"),
+		bucketNameIssued:    []byte("issuedcerts"),
+		bucketNameKeyring:   []byte("sshcakeyring"),
+		bucketNameLockdown:  []byte("lockdown"),
+		bucketNameOwners:    []byte("pubkeyowners"),
+		bucketNameOwnersMD5: []byte("pubkeyowners-md5"),
+		bucketNameRevoked:   []byte("revoked"),
+		bucketNameSSHSerial: []byte("sshserial"),
+		bucketNameTLSSerial: []byte("certserial"),
+	}
+
+	var err error
+	conf.db, err = bolt.Open(filepath.Join(testTempDir(t), "curse.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conf.db.Close() })
+
+	signer := newTestSigner(t)
+	conf.sshCA = &caKeyring{keys: []*caKey{{
+		State:  caKeyActive,
+		fp:     []byte(ssh.FingerprintSHA256(signer.PublicKey())),
+		signer: signer,
+	}}}
+
+	return conf
+}
+
+// testUserCA issues user identity certificates for handler tests
+type testUserCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestUserCA(t *testing.T) *testUserCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotAfter:              time.Now().Add(time.Hour),
+		NotBefore:             time.Now().Add(-time.Minute),
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test user ca"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testUserCA{cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+
+	return ca
+}
+
+// request builds a request for path as if it came over a TLS connection with a client certificate for user
+func (ca *testUserCA) request(t *testing.T, user, method, path string, p interface{}) *http.Request {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Minute),
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: user},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body []byte
+	if p != nil {
+		body, err = json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert, ca.cert}},
+	}
+
+	return r
+}
+
+// signTestProof signs a key proof nonce the way jinx does
+func signTestProof(t *testing.T, signer ssh.Signer, nonce string) string {
+	t.Helper()
+
+	sig, err := signer.Sign(rand.Reader, []byte(challengePrefix+nonce))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(ssh.Marshal(sig))
+}
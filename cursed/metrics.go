@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency histogram buckets in seconds
+var metricBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type histogram struct {
+	count  uint64
+	counts []uint64
+	sum    float64
+}
+
+type metrics struct {
+	boltTx       map[string]*histogram
+	denials      map[string]uint64
+	exec         map[string]*histogram
+	execTimeouts map[string]uint64
+	issued       map[string]uint64
+	mu           sync.Mutex
+	requests     map[string]uint64
+	sign         map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		boltTx:       make(map[string]*histogram),
+		denials:      make(map[string]uint64),
+		exec:         make(map[string]*histogram),
+		execTimeouts: make(map[string]uint64),
+		issued:       make(map[string]uint64),
+		requests:     make(map[string]uint64),
+		sign:         make(map[string]*histogram),
+	}
+}
+
+func metricLabels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricBuckets))
+	}
+	for i, le := range metricBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func observeSince(hs map[string]*histogram, key string, start time.Time) {
+	h := hs[key]
+	if h == nil {
+		h = &histogram{}
+		hs[key] = h
+	}
+	h.observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) incRequest(handler string, code int, reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[metricLabels("handler", handler, "code", strconv.Itoa(code))]++
+
+	// Denials are counted by the fixed reason the handler gave for them
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		if reason == "" {
+			reason = "other"
+		}
+		m.denials[metricLabels("handler", handler, "reason", reason)]++
+	}
+}
+
+func (m *metrics) observeSign(certType string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := metricLabels("type", certType)
+	m.issued[key]++
+	observeSince(m.sign, key, start)
+}
+
+func (m *metrics) observeExec(command string, start time.Time, timedOut bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := metricLabels("command", command)
+	observeSince(m.exec, key, start)
+	if timedOut {
+		m.execTimeouts[key]++
+	}
+}
+
+func (m *metrics) observeBoltTx(kind string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	observeSince(m.boltTx, metricLabels("kind", kind), start)
+}
+
+func writeCounters(w io.Writer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, key, values[key])
+	}
+}
+
+func writeHistograms(w io.Writer, name, help string, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	keys := make([]string, 0, len(hs))
+	for key := range hs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := hs[key]
+		for i, le := range metricBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, key, le, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, key, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, key, h.count)
+	}
+}
+
+func (m *metrics) write(w io.Writer, conf *config) {
+	m.mu.Lock()
+	writeCounters(w, "curse_requests_total", "Requests handled, by handler and response status.", m.requests)
+	writeCounters(w, "curse_denials_total", "Requests denied, by handler and reason.", m.denials)
+	writeCounters(w, "curse_certs_issued_total", "Certificates signed, by certificate type.", m.issued)
+	writeHistograms(w, "curse_sign_duration_seconds", "Time taken to sign certificates, by certificate type.", m.sign)
+	writeHistograms(w, "curse_exec_duration_seconds", "Run time of auth helper commands.", m.exec)
+	writeCounters(w, "curse_exec_timeouts_total", "Auth helper commands killed after authtimeout.", m.execTimeouts)
+	writeHistograms(w, "curse_bolt_tx_duration_seconds", "Duration of database transactions, by kind.", m.boltTx)
+	m.mu.Unlock()
+
+	// Work out how long we have until the TLS CA needs replacing
+	if conf.tlsCACert != nil {
+		days := math.Floor(time.Until(conf.tlsCACert.NotAfter).Hours() / 24)
+		fmt.Fprintf(w, "# HELP curse_tls_ca_expiry_days Days until the TLS CA certificate expires.\n")
+		fmt.Fprintf(w, "# TYPE curse_tls_ca_expiry_days gauge\n")
+		fmt.Fprintf(w, "curse_tls_ca_expiry_days %g\n", days)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	conf.metrics.write(w, conf)
+}
+
+func serveMetrics(live *confHolder) {
+	conf := live.get()
+	if conf.metrics == nil {
+		return
+	}
+
+	s := http.NewServeMux()
+	s.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metricsHandler(w, r, live.get())
+	})
+
+	// Metrics are served over plain HTTP on their own listener, so scrapers don't need a client certificate
+	server := &http.Server{
+		Addr:         conf.MetricsAddr,
+		Handler:      s,
+		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			log.Printf("metrics listener: %v", err)
+		}
+	}()
+}
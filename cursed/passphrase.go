@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bgentry/speakeasy"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type passphrase struct {
+	mu     sync.Mutex
+	name   string
+	source string
+	value  []byte
+}
+
+func newPassphrase(name, source string) (*passphrase, error) {
+	// Sources are "prompt", "env:VARIABLE" or "file:/path/to/file"
+	switch {
+	case source == "", source == "prompt":
+	case strings.HasPrefix(source, "env:") && len(source) > 4:
+	case strings.HasPrefix(source, "file:") && len(source) > 5:
+	default:
+		return nil, fmt.Errorf("invalid %s passphrase source (must be prompt, env:VARIABLE or file:/path): %s", name, source)
+	}
+
+	return &passphrase{name: name, source: source}, nil
+}
+
+func (p *passphrase) configured() bool {
+	return p != nil && p.source != ""
+}
+
+func (p *passphrase) get() ([]byte, error) {
+	if !p.configured() {
+		return nil, fmt.Errorf("%s key is encrypted, but no passphrase source is configured", p.name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Only ask once, since several keys may share a passphrase
+	if p.value != nil {
+		return p.value, nil
+	}
+
+	switch {
+	case p.source == "prompt":
+		pass, err := speakeasy.Ask(fmt.Sprintf("%s passphrase: ", p.name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s passphrase: %v", p.name, err)
+		}
+		p.value = []byte(pass)
+	case strings.HasPrefix(p.source, "env:"):
+		pass, ok := os.LookupEnv(strings.TrimPrefix(p.source, "env:"))
+		if !ok {
+			return nil, fmt.Errorf("%s passphrase environment variable not set: %s", p.name, strings.TrimPrefix(p.source, "env:"))
+		}
+		p.value = []byte(pass)
+	case strings.HasPrefix(p.source, "file:"):
+		pass, err := ioutil.ReadFile(expandHome(strings.TrimPrefix(p.source, "file:")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s passphrase file: %v", p.name, err)
+		}
+		p.value = bytes.TrimRight(pass, "\r\n")
+	}
+
+	return p.value, nil
+}
+
+// PKCS#8 key encryption (RFC 8018) object identifiers
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// PBKDF2 settings for keys we encrypt
+const (
+	pbkdf2Rounds   = 600000
+	pbkdf2SaltSize = 16
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algo pkix.AlgorithmIdentifier
+	Data []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Cipher pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func decryptPEMKey(block *pem.Block, p *passphrase) (crypto.PrivateKey, error) {
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		pass, err := p.get()
+		if err != nil {
+			return nil, err
+		}
+		der, err := decryptPKCS8(block.Bytes, pass)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s key: %v", p.name, err)
+		}
+		return x509.ParsePKCS8PrivateKey(der)
+	case x509.IsEncryptedPEMBlock(block):
+		// Keys encrypted with the legacy OpenSSL PEM format can still be read, but we never
+		// write them, as the format is insecure
+		pass, err := p.get()
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.DecryptPEMBlock(block, pass)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s key: %v", p.name, err)
+		}
+		return parsePrivateKeyDER(block.Type, der)
+	}
+
+	return parsePrivateKeyDER(block.Type, block.Bytes)
+}
+
+func parsePrivateKeyDER(blockType string, der []byte) (crypto.PrivateKey, error) {
+	if blockType == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(der)
+	}
+
+	return x509.ParsePKCS8PrivateKey(der)
+}
+
+func decryptPKCS8(der, pass []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted pkcs8 key: %v", err)
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported pkcs8 encryption (only pbes2 is supported): %v", info.Algo.Algorithm)
+	}
+
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pbes2 parameters: %v", err)
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported pbes2 key derivation (only pbkdf2 is supported): %v", params.KDF.Algorithm)
+	}
+	var kdf pbkdf2Params
+	_, err = asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pbkdf2 parameters: %v", err)
+	}
+
+	// PBKDF2 defaults to HMAC-SHA1 when no PRF is given
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported pbkdf2 prf: %v", kdf.PRF.Algorithm)
+	}
+
+	var keyLen int
+	switch {
+	case params.Cipher.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.Cipher.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.Cipher.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported pbes2 cipher (only aes-cbc is supported): %v", params.Cipher.Algorithm)
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(params.Cipher.Parameters.FullBytes, &iv)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid aes-cbc iv")
+	}
+	if len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted key length")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(pass, kdf.Salt, kdf.Iterations, keyLen, prf))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, info.Data)
+
+	// A wrong passphrase almost always leaves bad padding
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, fmt.Errorf("incorrect passphrase")
+	}
+	for _, b := range out[len(out)-pad:] {
+		if int(b) != pad {
+			return nil, fmt.Errorf("incorrect passphrase")
+		}
+	}
+
+	return out[:len(out)-pad], nil
+}
+
+func encryptPEMKey(key crypto.PrivateKey, p *passphrase) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s key for encryption: %v", p.name, err)
+	}
+	pass, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypt with PBES2, using PBKDF2-HMAC-SHA256 and AES-256-CBC, as openssl pkcs8 -topk8 does
+	salt := make([]byte, pbkdf2SaltSize)
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(salt)
+	if err == nil {
+		_, err = rand.Read(iv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s key: %v", p.name, err)
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(pass, salt, pbkdf2Rounds, 32, sha256.New))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s key: %v", p.name, err)
+	}
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(der, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: pbkdf2Rounds,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		Cipher: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	enc, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data: data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s key: %v", p.name, err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: enc}), nil
+}
@@ -4,10 +4,62 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
-func loadPrincipalMap(conf config) (map[string]string, error) {
+var groupNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.][A-Za-z0-9_.-]*$`)
+
+type principalAliases struct {
+	exact    map[string][]string
+	patterns []*principalPattern
+}
+
+type principalPattern struct {
+	glob   string
+	groups []string
+	re     *regexp.Regexp
+}
+
+// Errors found within a group set, which already say where they are
+type groupSetError struct {
+	error
+}
+
+// Entries in a v2 aliases file
+type aliasEntry struct {
+	Groups    []string `yaml:"groups"`
+	Principal string   `yaml:"principal"`
+	Regex     string   `yaml:"regex"`
+
+	line int
+}
+
+type aliasGroupSet struct {
+	groups []string
+	line   int
+}
+
+type aliasFile struct {
+	GroupSets  map[string]*aliasGroupSet `yaml:"groupsets"`
+	Principals []*aliasEntry             `yaml:"principals"`
+	Version    int                       `yaml:"version"`
+}
+
+func loadPrincipalMap(conf config) (*principalAliases, error) {
+	// YAML files use the v2 format, anything else is the original principal:group1,group2 format
+	switch filepath.Ext(conf.PrincipalAliases) {
+	case ".yaml", ".yml":
+		return loadPrincipalAliasesV2(conf.PrincipalAliases)
+	}
+
 	file, err := os.Open(conf.PrincipalAliases)
 	if err != nil {
 		err = fmt.Errorf("failed to open principalaliases file: '%v'", err)
@@ -15,11 +67,13 @@ func loadPrincipalMap(conf config) (map[string]string, error) {
 	}
 	defer file.Close()
 
-	principalMap := make(map[string]string)
+	pa := &principalAliases{exact: make(map[string][]string)}
 
 	scanner := bufio.NewScanner(file)
+	lineNum := 0
 Line:
 	for scanner.Scan() {
+		lineNum++
 		line := scanner.Bytes()
 		if len(line) == 0 || line[0] == '#' {
 			continue
@@ -28,12 +82,20 @@ Line:
 		// Split line into principal/group aliases on colon
 		parts := bytes.Split(line, []byte{':'})
 		if len(parts) < 2 {
+			log.Printf("%s: line %d: skipping line without a principal:groups separator", conf.PrincipalAliases, lineNum)
 			continue
 		}
 
 		// Split groups on comma
-		groups := bytes.Split(parts[1], []byte{','})
+		var groups []string
+		for _, v := range bytes.Split(parts[1], []byte{','}) {
+			g := string(bytes.TrimSpace(v))
+			if g != "" {
+				groups = append(groups, g)
+			}
+		}
 		if len(groups) < 1 {
+			log.Printf("%s: line %d: skipping line without any groups", conf.PrincipalAliases, lineNum)
 			continue
 		}
 
@@ -42,14 +104,197 @@ Line:
 		// Check for wildcard groups
 		for _, v := range groups {
 			// If we got a wildcard, ignore everything else
-			if bytes.Equal(v, []byte{'*'}) {
-				principalMap[prin] = "*"
+			if v == "*" {
+				pa.exact[prin] = []string{"*"}
 				continue Line
 			}
 		}
 
-		principalMap[prin] = string(parts[1])
+		pa.exact[prin] = groups
+	}
+
+	return pa, nil
+}
+
+func loadPrincipalAliasesV2(file string) (*principalAliases, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open principalaliases file: '%v'", err)
+	}
+
+	// Reject misspelled keys rather than silently ignoring them
+	var af aliasFile
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	err = dec.Decode(&af)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if af.Version != 2 {
+		return nil, fmt.Errorf("%s: unsupported principal aliases version: %d", file, af.Version)
+	}
+
+	// Check every group set up front, so mistakes in unused sets are still caught
+	resolved := make(map[string][]string)
+	for name := range af.GroupSets {
+		_, err = resolveGroupSet(af.GroupSets, name, resolved, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	pa := &principalAliases{exact: make(map[string][]string)}
+	seen := make(map[string]int)
+	for _, e := range af.Principals {
+		if (e.Principal == "") == (e.Regex == "") {
+			return nil, fmt.Errorf("%s: line %d: each entry needs exactly one of principal or regex", file, e.line)
+		}
+		if len(e.Groups) == 0 {
+			return nil, fmt.Errorf("%s: line %d: no groups given", file, e.line)
+		}
+
+		groups, err := expandGroups(af.GroupSets, e.Groups, resolved, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", file, e.line, err)
+		}
+
+		switch {
+		case e.Regex != "":
+			// Anchor regexes, so they match the whole principal
+			re, err := regexp.Compile("^(?:" + e.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("%s: line %d: invalid regex: %v", file, e.line, err)
+			}
+			pa.patterns = append(pa.patterns, &principalPattern{groups: groups, re: re})
+		case strings.ContainsAny(e.Principal, "*?["):
+			_, err := path.Match(e.Principal, "")
+			if err != nil {
+				return nil, fmt.Errorf("%s: line %d: invalid principal pattern: %s", file, e.line, e.Principal)
+			}
+			pa.patterns = append(pa.patterns, &principalPattern{glob: e.Principal, groups: groups})
+		default:
+			if prev, ok := seen[e.Principal]; ok {
+				return nil, fmt.Errorf("%s: line %d: principal %s already listed on line %d", file, e.line, e.Principal, prev)
+			}
+			seen[e.Principal] = e.line
+			pa.exact[e.Principal] = groups
+		}
+	}
+
+	return pa, nil
+}
+
+func resolveGroupSet(sets map[string]*aliasGroupSet, name string, resolved map[string][]string, stack []string) ([]string, error) {
+	if groups, ok := resolved[name]; ok {
+		return groups, nil
+	}
+
+	set, ok := sets[name]
+	if !ok || set == nil {
+		return nil, fmt.Errorf("unknown group set: @%s", name)
+	}
+	for _, s := range stack {
+		if s == name {
+			return nil, &groupSetError{fmt.Errorf("line %d: group set @%s includes itself: @%s", set.line, name, strings.Join(append(stack, name), " -> @"))}
+		}
+	}
+
+	groups, err := expandGroups(sets, set.groups, resolved, append(stack, name))
+	if _, nested := err.(*groupSetError); nested {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &groupSetError{fmt.Errorf("line %d: group set @%s: %v", set.line, name, err)}
+	}
+	resolved[name] = groups
+
+	return groups, nil
+}
+
+func expandGroups(sets map[string]*aliasGroupSet, names []string, resolved map[string][]string, stack []string) ([]string, error) {
+	var groups []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		var add []string
+		switch {
+		case name == "*":
+			// A wildcard allows anyone, so the other groups don't matter
+			return []string{"*"}, nil
+		case strings.HasPrefix(name, "@"):
+			set, err := resolveGroupSet(sets, strings.TrimPrefix(name, "@"), resolved, stack)
+			if err != nil {
+				return nil, err
+			}
+			add = set
+		case groupNameRegex.MatchString(name):
+			add = []string{name}
+		default:
+			return nil, fmt.Errorf("invalid group name: %q", name)
+		}
+
+		for _, g := range add {
+			if g == "*" {
+				return []string{"*"}, nil
+			}
+			if !seen[g] {
+				seen[g] = true
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+func (pa *principalAliases) groups(principal string) []string {
+	if pa == nil {
+		return nil
+	}
+
+	// Exact matches take precedence, then patterns in the order they're listed
+	if groups, ok := pa.exact[principal]; ok {
+		return groups
+	}
+	for _, p := range pa.patterns {
+		if p.re != nil && p.re.MatchString(principal) {
+			return p.groups
+		}
+		if ok, _ := path.Match(p.glob, principal); ok && p.glob != "" {
+			return p.groups
+		}
+	}
+
+	return nil
+}
+
+func (e *aliasEntry) UnmarshalYAML(n *yaml.Node) error {
+	// Node.Decode doesn't check for unknown fields, so do it ourselves
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i < len(n.Content); i += 2 {
+			switch n.Content[i].Value {
+			case "groups", "principal", "regex":
+			default:
+				return fmt.Errorf("line %d: unknown field %q", n.Content[i].Line, n.Content[i].Value)
+			}
+		}
+	}
+
+	type plain aliasEntry
+	err := n.Decode((*plain)(e))
+	if err != nil {
+		return err
+	}
+	e.line = n.Line
+
+	return nil
+}
+
+func (s *aliasGroupSet) UnmarshalYAML(n *yaml.Node) error {
+	err := n.Decode(&s.groups)
+	if err != nil {
+		return err
 	}
+	s.line = n.Line
 
-	return principalMap, nil
+	return nil
 }
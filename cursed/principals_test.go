@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTestAliases(t *testing.T, name, aliases string) string {
+	t.Helper()
+
+	path := filepath.Join(testTempDir(t), name)
+	err := ioutil.WriteFile(path, []byte(aliases), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestPrincipalAliasesV2(t *testing.T) {
+	// The example file doubles as our main fixture
+	pa, err := loadPrincipalAliasesV2("aliases.yaml-example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		principal string
+		groups    []string
+	}{
+		{"root", []string{"wheel", "sysadmin"}},
+		{"db-main", []string{"dba", "wheel", "sysadmin"}},
+		{"app-web", []string{"deploy", "wheel", "sysadmin"}},
+		{"app-web2", nil},
+		{"guest", []string{"*"}},
+		{"nobody", nil},
+	}
+	for _, tt := range tests {
+		got := pa.groups(tt.principal)
+		if !reflect.DeepEqual(got, tt.groups) {
+			t.Errorf("groups(%s): got %v, want %v", tt.principal, got, tt.groups)
+		}
+	}
+}
+
+func TestPrincipalAliasesV2Precedence(t *testing.T) {
+	pa, err := loadPrincipalAliasesV2(writeTestAliases(t, "aliases.yaml", `
+version: 2
+groupsets:
+  everyone: [staff, "*"]
+principals:
+  - principal: "web*"
+    groups: [web]
+  - regex: "web[0-9]+"
+    groups: [ops]
+  - principal: web1
+    groups: [web1-admins]
+  - principal: shared
+    groups: [a, b, a, "@everyone"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exact principals win, then patterns in the order they're listed
+	for principal, want := range map[string][]string{
+		"web1":   {"web1-admins"},
+		"web2":   {"web"},
+		"webapp": {"web"},
+		"shared": {"*"},
+	} {
+		if got := pa.groups(principal); !reflect.DeepEqual(got, want) {
+			t.Errorf("groups(%s): got %v, want %v", principal, got, want)
+		}
+	}
+}
+
+func TestPrincipalAliasesV2Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases string
+		err     string
+	}{
+		{"version", "version: 1\n", "unsupported principal aliases version: 1"},
+		{"unknown top level field", "version: 2\nprincipal: []\n", "field principal not found"},
+		{"unknown entry field", "version: 2\nprincipals:\n  - principal: root\n    group: [wheel]\n", `line 4: unknown field "group"`},
+		{"both principal and regex", "version: 2\nprincipals:\n  - principal: root\n    regex: root\n    groups: [wheel]\n", "line 3: each entry needs exactly one"},
+		{"no groups", "version: 2\nprincipals:\n  - principal: root\n", "line 3: no groups given"},
+		{"bad group", "version: 2\nprincipals:\n  - principal: root\n    groups: [\"wheel;rm\"]\n", `line 3: invalid group name: "wheel;rm"`},
+		{"bad regex", "version: 2\nprincipals:\n  - regex: \"app-(\"\n    groups: [deploy]\n", "line 3: invalid regex"},
+		{"bad glob", "version: 2\nprincipals:\n  - principal: \"app-[\"\n    groups: [deploy]\n", "line 3: invalid principal pattern"},
+		{"duplicate principal", "version: 2\nprincipals:\n  - principal: root\n    groups: [wheel]\n  - principal: root\n    groups: [admin]\n", "line 5: principal root already listed on line 3"},
+		{"unknown set", "version: 2\nprincipals:\n  - principal: root\n    groups: [\"@admins\"]\n", "line 3: unknown group set: @admins"},
+		{"set cycle", "version: 2\ngroupsets:\n  a: [\"@b\"]\n  b: [\"@a\"]\n", "includes itself"},
+		{"bad group in unused set", "version: 2\ngroupsets:\n  unused: [\"not a group\"]\n", `line 3: group set @unused: invalid group name`},
+	}
+	for _, tt := range tests {
+		_, err := loadPrincipalAliasesV2(writeTestAliases(t, "aliases.yaml", tt.aliases))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestPrincipalAliasesLegacy(t *testing.T) {
+	path := writeTestAliases(t, "aliases.conf", `# principal:groups
+root:wheel, sysadmin
+guest:staff,*
+nogroups:
+no separator
+deploy:deploy
+`)
+	pa, err := loadPrincipalMap(config{PrincipalAliases: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for principal, want := range map[string][]string{
+		"root":     {"wheel", "sysadmin"},
+		"guest":    {"*"},
+		"deploy":   {"deploy"},
+		"nogroups": nil,
+	} {
+		if got := pa.groups(principal); !reflect.DeepEqual(got, want) {
+			t.Errorf("groups(%s): got %v, want %v", principal, got, want)
+		}
+	}
+
+	// Files ending in .yaml are read in the v2 format
+	path = writeTestAliases(t, "aliases.yaml", "version: 2\nprincipals:\n  - principal: root\n    groups: [wheel]\n")
+	pa, err = loadPrincipalMap(config{PrincipalAliases: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pa.groups("root"); !reflect.DeepEqual(got, []string{"wheel"}) {
+		t.Errorf("groups(root): got %v from the v2 file", got)
+	}
+}
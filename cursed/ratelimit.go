@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errExecBusy = errors.New("too many auth helper processes running")
+
+type tokenBucket struct {
+	last   time.Time
+	tokens float64
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	burst     float64
+	lastPrune time.Time
+	rate      float64
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	// A rate of zero disables the limiter
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		burst:   float64(burst),
+		rate:    float64(perMinute) / 60,
+	}
+}
+
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+
+	// Forget about clients whose buckets have refilled, so the map doesn't grow forever
+	if now.Sub(rl.lastPrune) > time.Minute {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{last: now, tokens: rl.burst}
+		rl.buckets[key] = b
+	}
+
+	// Refill the bucket for the time since we last saw this client
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+
+	return true, 0
+}
+
+func tooManyRequests(w http.ResponseWriter, retry time.Duration) {
+	secs := int(math.Ceil(retry.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+func limitRequests(live *confHolder, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := live.get()
+		ip := clientIP(r)
+		un := "-"
+		logger := newLog(conf, ip, "limit", "")
+
+		// Every request reaches us through a bastion, so limit each connecting address as a bastion,
+		// and each user with a verified client certificate. The per-client limit is applied by the
+		// handlers once they know the relayed user IP. Health probes count too, since they're
+		// unauthenticated and /readyz does real work
+		ok, retry := conf.bastionLimiter.allow(ip)
+		if !ok {
+			code := http.StatusTooManyRequests
+			logger.audit(un, code, fmt.Sprintf("rate limit exceeded for bastion: %s", ip),
+				auditInfo{Event: eventRateLimited, Reason: "bastion"})
+			tooManyRequests(w, retry)
+			return
+		}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			un = r.TLS.VerifiedChains[0][0].Subject.CommonName
+			ok, retry := conf.userLimiter.allow(un)
+			if !ok {
+				code := http.StatusTooManyRequests
+				logger.audit(un, code, fmt.Sprintf("rate limit exceeded for user: %s", un),
+					auditInfo{Event: eventRateLimited, Reason: "user"})
+				tooManyRequests(w, retry)
+				return
+			}
+		}
+
+		// Cap request body sizes, rejecting oversized requests up front when we can
+		if r.ContentLength > conf.MaxRequestBytes {
+			code := http.StatusRequestEntityTooLarge
+			logger.req(un, code, fmt.Sprintf("request body too large: %d bytes", r.ContentLength))
+			http.Error(w, "request too large", code)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, conf.MaxRequestBytes)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitClient applies the per-client rate limit to the user IP a bastion relayed with a request.
+// Requests without one are only covered by the bastion and user limits
+func limitClient(conf *config, w http.ResponseWriter, logger *logTmpl, un, userIP string) bool {
+	if userIP == "" {
+		return true
+	}
+
+	ok, retry := conf.ipLimiter.allow(userIP)
+	if !ok {
+		code := http.StatusTooManyRequests
+		logger.audit(un, code, fmt.Sprintf("rate limit exceeded for client ip: %s", userIP),
+			auditInfo{Event: eventRateLimited, Reason: "client-ip"})
+		tooManyRequests(w, retry)
+	}
+
+	return ok
+}
+
+// clientIP returns the address of the host connected to us, which is also safe for IPv6 peers
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func acquireExec(conf *config) error {
+	if conf.execSlots == nil {
+		return nil
+	}
+
+	// Wait a short while for a free slot rather than queueing forever
+	timer := time.NewTimer(conf.execWait)
+	defer timer.Stop()
+	select {
+	case conf.execSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errExecBusy
+	}
+}
+
+func releaseExec(conf *config) {
+	if conf.execSlots != nil {
+		<-conf.execSlots
+	}
+}
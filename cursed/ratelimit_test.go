@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		elapsed   time.Duration
+		allowed   int
+	}{
+		{"burst", 60, 3, 0, 0},
+		{"burst of one", 60, 0, 0, 0},
+		{"partial refill", 60, 3, 500 * time.Millisecond, 0},
+		{"one token", 60, 3, time.Second, 1},
+		{"two tokens", 60, 3, 2 * time.Second, 2},
+		{"refill capped at burst", 60, 3, time.Hour, 3},
+		{"slow rate", 1, 2, 30 * time.Second, 0},
+		{"slow rate refilled", 1, 2, time.Minute, 1},
+	}
+	for _, tt := range tests {
+		rl := newRateLimiter(tt.perMinute, tt.burst)
+		burst := int(rl.burst)
+
+		// A new client gets a full burst, and is then turned away until its bucket refills
+		for i := 0; i < burst; i++ {
+			if ok, _ := rl.allow("10.0.0.1"); !ok {
+				t.Fatalf("%s: request %d of a %d burst denied", tt.name, i+1, burst)
+			}
+		}
+		ok, retry := rl.allow("10.0.0.1")
+		if ok {
+			t.Fatalf("%s: request after the burst allowed", tt.name)
+		}
+		want := time.Duration(float64(time.Minute) / float64(tt.perMinute))
+		if retry <= 0 || retry > want {
+			t.Errorf("%s: got retry after %v, want up to %v", tt.name, retry, want)
+		}
+
+		// Pretend time has passed since the client's last request
+		rl.buckets["10.0.0.1"].last = rl.buckets["10.0.0.1"].last.Add(-tt.elapsed)
+		allowed := 0
+		for {
+			if ok, _ := rl.allow("10.0.0.1"); !ok {
+				break
+			}
+			allowed++
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: got %d requests after %v, want %d", tt.name, allowed, tt.elapsed, tt.allowed)
+		}
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	rl := newRateLimiter(60, 1)
+	if ok, _ := rl.allow("alice"); !ok {
+		t.Fatal("first request denied")
+	}
+	if ok, _ := rl.allow("alice"); ok {
+		t.Error("second request allowed")
+	}
+	if ok, _ := rl.allow("bob"); !ok {
+		t.Error("another client shares alice's bucket")
+	}
+
+	// A rate of zero turns the limiter off
+	rl = newRateLimiter(0, 1)
+	for i := 0; i < 10; i++ {
+		if ok, _ := rl.allow("alice"); !ok {
+			t.Fatal("disabled limiter denied a request")
+		}
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	ca := newTestUserCA(t)
+	conf := &config{
+		MaxRequestBytes: 4096,
+		bastionLimiter:  newRateLimiter(60, 2),
+		userLimiter:     newRateLimiter(60, 1),
+	}
+	h := limitRequests(newConfHolder(conf), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(r *http.Request, remoteAddr string) *httptest.ResponseRecorder {
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Each user with a client certificate gets their own limit
+	if w := serve(ca.request(t, "alice", "GET", "/", nil), "10.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("first request: got %d", w.Code)
+	}
+	w := serve(ca.request(t, "alice", "GET", "/", nil), "10.0.0.1:5001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("user over limit: got %d", w.Code)
+	}
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || secs < 1 {
+		t.Errorf("got Retry-After %q, want whole seconds", w.Header().Get("Retry-After"))
+	}
+
+	// The bastion's limit covers every request it relays, whichever port or user they come from
+	if w := serve(ca.request(t, "bob", "GET", "/", nil), "10.0.0.1:5002"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("bastion over limit: got %d", w.Code)
+	}
+
+	// IPv6 bastions are keyed on their whole address
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if w := serve(httptest.NewRequest("GET", "/healthz", nil), "[2001:db8::1]:"+strconv.Itoa(5000+i)); w.Code != want {
+			t.Errorf("ipv6 request %d: got %d, want %d", i+1, w.Code, want)
+		}
+	}
+	if w := serve(httptest.NewRequest("GET", "/healthz", nil), "[2001:db8::2]:5000"); w.Code != http.StatusOK {
+		t.Errorf("ipv6 bastion sharing a prefix was limited: got %d", w.Code)
+	}
+}
+
+func TestLimitClient(t *testing.T) {
+	conf := &config{ipLimiter: newRateLimiter(60, 1)}
+	logger := newLog(conf, "10.0.0.1", "ssh", "")
+
+	// Requests without a relayed user IP aren't limited per client
+	for i := 0; i < 3; i++ {
+		if !limitClient(conf, httptest.NewRecorder(), logger, "alice", "") {
+			t.Fatal("request without a user ip limited")
+		}
+	}
+
+	if !limitClient(conf, httptest.NewRecorder(), logger, "alice", "10.1.2.3") {
+		t.Fatal("first request limited")
+	}
+	w := httptest.NewRecorder()
+	if limitClient(conf, w, logger, "alice", "10.1.2.3") {
+		t.Fatal("second request allowed")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestExecSlots(t *testing.T) {
+	conf := &config{execSlots: make(chan struct{}, 2), execWait: 10 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		if err := acquireExec(conf); err != nil {
+			t.Fatalf("slot %d: %v", i+1, err)
+		}
+	}
+	if err := acquireExec(conf); err != errExecBusy {
+		t.Fatalf("got %v with every slot taken, want errExecBusy", err)
+	}
+
+	// A freed slot can be taken by a waiting request
+	conf.execWait = 5 * time.Second
+	done := make(chan error)
+	go func() { done <- acquireExec(conf) }()
+	releaseExec(conf)
+	if err := <-done; err != nil {
+		t.Errorf("waiting request didn't get the freed slot: %v", err)
+	}
+
+	// No slots means no limit
+	conf = &config{}
+	for i := 0; i < 10; i++ {
+		if err := acquireExec(conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
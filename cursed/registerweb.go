@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func registerHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "register", "")
+
+	// Load our form parameters into a struct
+	p, err := getJSONParams(w, r, conf)
+	if err != nil {
+		msg := fmt.Sprintf("bad json in request: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, "bad request", code)
+		return
+	}
+
+	// Update our logger
+	logger.rip = p.UserIP
+
+	// Pubkeys are registered to the user identity in the client certificate
+	clientCert, err := verifyClientCert(r, conf.tlsUserCAPool)
+	if err != nil {
+		msg := fmt.Sprintf("no valid client certificate provided: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "no-client-cert"})
+		http.Error(w, "not authorized", code)
+		return
+	}
+	p.user = clientCert.Subject.CommonName
+	un = p.user
+
+	// Limit requests from each client the bastion relays for
+	if !limitClient(conf, w, logger, un, p.UserIP) {
+		return
+	}
+
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.Key))
+	if err != nil {
+		msg := "unable to parse authorized key"
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+	fp := ssh.FingerprintSHA256(pk)
+
+	// Make sure the pubkey meets our algorithm and strength requirements
+	err = conf.keyPolicy.check(pk)
+	if err != nil {
+		msg := fmt.Sprintf("pubkey rejected: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+
+	// Registering claims the pubkey for this user, so always make sure they hold its private key
+	err = verifyKeyProof(conf, pk, p)
+	if err != nil {
+		msg := fmt.Sprintf("key proof failed: user[%s] pubkey[%s]: %v", p.user, fp, err)
+		code := http.StatusForbidden
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Fingerprint: fp, Reason: "key-proof-failed"})
+		http.Error(w, fmt.Sprintf("key proof failed: %v", err), code)
+		return
+	}
+
+	// Refuse to register revoked pubkeys
+	revoked, err := pubKeyRevoked(conf, pk)
+	if err != nil {
+		msg := fmt.Sprintf("failed to check pubkey revocation: %v", err)
+		code := http.StatusInternalServerError
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+	if revoked {
+		msg := fmt.Sprintf("pubkey revoked: user[%s] pubkey[%s]", p.user, fp)
+		code := http.StatusForbidden
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Fingerprint: fp, Reason: "pubkey-revoked"})
+		http.Error(w, "submitted pubkey has been revoked", code)
+		return
+	}
+
+	// Register the pubkey, which also starts its age clock if we haven't seen it before
+	expired, err := checkPubKeyAge(conf, pk, p.user)
+	if _, ok := err.(*pubKeyOwnerError); ok {
+		code := http.StatusConflict
+		msg := fmt.Sprintf("SECURITY pubkey owner mismatch: %v", err)
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Fingerprint: fp, Level: "critical",
+			Reason: "pubkey-owner-mismatch"})
+		http.Error(w, "submitted pubkey is registered to another user", code)
+		return
+	}
+	if expired {
+		code := http.StatusUnprocessableEntity
+		msg := fmt.Sprintf("pubkey expired: user[%s] pubkey[%s]: %v", p.user, fp, err)
+		logger.audit(un, code, msg, auditInfo{Event: eventPubKeyExpired, Fingerprint: fp, Reason: "pubkey-expired"})
+		http.Error(w, "submitted pubkey is too old. Please generate new key.", code)
+		return
+	}
+
+	// Log the request
+	code := http.StatusOK
+	msg := fmt.Sprintf("registered pubkey[%s] to user[%s]", fp, p.user)
+	logger.audit(un, code, msg, auditInfo{Event: eventPubKeyRegistered, Fingerprint: fp})
+
+	fmt.Fprintln(w, msg)
+}
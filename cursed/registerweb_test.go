@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRegisterKeyProof(t *testing.T) {
+	ca := newTestUserCA(t)
+	conf := newTestHandlerConf(t, ca)
+	key := newTestSigner(t)
+	pub := string(ssh.MarshalAuthorizedKey(key.PublicKey()))
+
+	register := func(user string, p httpParams) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		registerHandler(w, ca.request(t, user, "POST", "/register/", p), conf)
+		return w
+	}
+
+	// Registering claims the pubkey, so a proof is needed even with requirekeyproof off
+	conf.RequireKeyProof = false
+	w := register("bob", httpParams{Key: pub})
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "key proof failed") {
+		t.Fatalf("registration without proof: got %d %s", w.Code, w.Body)
+	}
+
+	// Someone who only has the pubkey can't sign for it
+	n, _, _ := conf.challenges.issue("bob")
+	w = register("bob", httpParams{Key: pub, Nonce: n, Signature: signTestProof(t, newTestSigner(t), n)})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("registration with another key's proof: got %d %s", w.Code, w.Body)
+	}
+
+	// So the pubkey is still free for its holder to register
+	n, _, _ = conf.challenges.issue("alice")
+	w = register("alice", httpParams{Key: pub, Nonce: n, Signature: signTestProof(t, key, n)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("registration with proof: got %d %s", w.Code, w.Body)
+	}
+	owner, err := dbClaimPubKey(conf, ssh.FingerprintSHA256(key.PublicKey()), "bob")
+	if err != nil || owner != "alice" {
+		t.Errorf("pubkey owner: got %q %v, want alice", owner, err)
+	}
+}
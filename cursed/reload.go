@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type confHolder struct {
+	conf atomic.Value
+	mu   sync.Mutex
+}
+
+func newConfHolder(conf *config) *confHolder {
+	h := &confHolder{}
+	h.conf.Store(conf)
+
+	return h
+}
+
+func (h *confHolder) get() *config {
+	return h.conf.Load().(*config)
+}
+
+func (h *confHolder) reload() error {
+	// Only run one reload at a time
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	old := h.get()
+
+	// Re-read and validate our config file
+	err := viper.ReadInConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	conf, err := getConf()
+	if err != nil {
+		return err
+	}
+	conf.inherit(old)
+
+	// Reload the aliases/policy, CA keys and TLS material
+	err = setupConf(conf)
+	if err != nil {
+		return err
+	}
+
+	// Requests already in progress finish with the old config
+	h.conf.Store(conf)
+
+	// Hand scheduled CA key rotations over to the new keyring
+	old.sshCA.stopSchedule()
+	conf.sshCA.schedule()
+
+	return nil
+}
+
+func (h *confHolder) reloadOnSignal() {
+	// Reload our config on SIGHUP
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			err := h.reload()
+			if err != nil {
+				log.Printf("config reload failed, keeping the current config: %v", err)
+				continue
+			}
+			log.Print("config reloaded")
+		}
+	}()
+}
+
+// Carry over the state that's only set up at startup, such as the database and rate limiters,
+// from the config we're replacing
+func (conf *config) inherit(old *config) {
+	conf.audit = old.audit
+	conf.challenges = old.challenges
+	conf.db = old.db
+	conf.metrics = old.metrics
+	conf.webhooks = old.webhooks
+
+	// Rebuild the rate limiters whose settings changed. The others keep their clients' buckets
+	burst := conf.RateLimitBurst != old.RateLimitBurst
+	conf.bastionLimiter = inheritLimiter(old.bastionLimiter, burst || conf.RateLimitBastion != old.RateLimitBastion,
+		conf.RateLimitBastion, conf.RateLimitBurst)
+	conf.ipLimiter = inheritLimiter(old.ipLimiter, burst || conf.RateLimitIP != old.RateLimitIP,
+		conf.RateLimitIP, conf.RateLimitBurst)
+	conf.userLimiter = inheritLimiter(old.userLimiter, burst || conf.RateLimitUser != old.RateLimitUser,
+		conf.RateLimitUser, conf.RateLimitBurst)
+
+	// Requests already running give their slots back to the old pool, so both pools are in use
+	// until they finish
+	conf.execSlots = old.execSlots
+	if conf.ExecConcurrency != old.ExecConcurrency {
+		conf.execSlots = nil
+		if conf.ExecConcurrency > 0 {
+			conf.execSlots = make(chan struct{}, conf.ExecConcurrency)
+		}
+	}
+	conf.execWait = time.Duration(conf.ExecQueueTimeout) * time.Second
+
+	// Nonces already issued keep the lifetime they were issued with
+	if conf.ChallengeTTL != old.ChallengeTTL {
+		conf.challenges.setTTL(time.Duration(conf.ChallengeTTL) * time.Second)
+	}
+
+	// Reuse passphrases we've already been given, since we can't prompt for them again
+	if conf.CAPassphrase == old.CAPassphrase {
+		conf.caPass = old.caPass
+	}
+	if conf.SSLKeyPassphrase == old.SSLKeyPassphrase {
+		conf.tlsKeyPass = old.tlsKeyPass
+	}
+
+	// Settings that can't change without a restart
+	for _, s := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"addr", old.Addr, conf.Addr},
+		{"dbfile", old.DBFile, conf.DBFile},
+		{"logsinks", old.rawLogSinks, conf.rawLogSinks},
+		{"metricsaddr", old.MetricsAddr, conf.MetricsAddr},
+		{"port", old.Port, conf.Port},
+		{"webhookretries", old.WebhookRetries, conf.WebhookRetries},
+		{"webhooks", old.rawWebhooks, conf.rawWebhooks},
+		{"webhookspooldir", old.WebhookSpoolDir, conf.WebhookSpoolDir},
+	} {
+		if s.old != s.new {
+			log.Printf("%s changed, restart cursed for it to take effect", s.name)
+		}
+	}
+}
+
+func inheritLimiter(old *rateLimiter, changed bool, perMinute, burst int) *rateLimiter {
+	if changed {
+		return newRateLimiter(perMinute, burst)
+	}
+
+	return old
+}
+
+// rawSettings flattens settings for comparison. Errors can't happen for the plain structs we use
+func rawSettings(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInheritStartupState(t *testing.T) {
+	old := &config{
+		ChallengeTTL:     60,
+		ExecConcurrency:  4,
+		RateLimitBastion: 600,
+		RateLimitBurst:   10,
+		RateLimitIP:      60,
+		RateLimitUser:    30,
+		challenges:       newChallengeStore(60),
+		execSlots:        make(chan struct{}, 4),
+	}
+	old.bastionLimiter = newRateLimiter(old.RateLimitBastion, old.RateLimitBurst)
+	old.ipLimiter = newRateLimiter(old.RateLimitIP, old.RateLimitBurst)
+	old.userLimiter = newRateLimiter(old.RateLimitUser, old.RateLimitBurst)
+
+	// Unchanged settings keep their state
+	conf := *old
+	conf.inherit(old)
+	if conf.bastionLimiter != old.bastionLimiter || conf.ipLimiter != old.ipLimiter ||
+		conf.userLimiter != old.userLimiter || conf.execSlots != old.execSlots {
+		t.Error("unchanged limits were rebuilt")
+	}
+
+	// Changed settings take effect
+	conf = *old
+	conf.ChallengeTTL = 120
+	conf.ExecConcurrency = 8
+	conf.RateLimitIP = 0
+	conf.RateLimitUser = 10
+	conf.inherit(old)
+	if conf.ipLimiter != nil {
+		t.Error("disabled ip limiter still set")
+	}
+	if conf.userLimiter == old.userLimiter || conf.userLimiter.rate != 10.0/60 {
+		t.Error("user limiter not rebuilt")
+	}
+	if conf.bastionLimiter != old.bastionLimiter {
+		t.Error("unchanged bastion limiter rebuilt")
+	}
+	if cap(conf.execSlots) != 8 {
+		t.Errorf("got %d exec slots, want 8", cap(conf.execSlots))
+	}
+	if conf.challenges.ttl.Seconds() != 120 {
+		t.Errorf("got challenge ttl %v, want 2m", conf.challenges.ttl)
+	}
+}
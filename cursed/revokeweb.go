@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+func revokeHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	// Set up some useful info for logging
+	ip := clientIP(r)
+	un := "-"
+
+	// Start up our logger
+	logger := newLog(conf, ip, "revoke", "")
+
+	if r.Method != http.MethodPost {
+		msg := fmt.Sprintf("invalid method: %s", r.Method)
+		code := http.StatusMethodNotAllowed
+		logger.req(un, code, msg)
+		http.Error(w, "method not allowed", code)
+		return
+	}
+
+	// Only admins may revoke certificates
+	user, err := adminUser(conf, r)
+	if user != "" {
+		un = user
+	}
+	if err != nil {
+		msg := fmt.Sprintf("authorization failure: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "not-admin"})
+		http.Error(w, "not authorized", code)
+		return
+	}
+
+	// Load our form parameters into a struct
+	p, err := getJSONParams(w, r, conf)
+	if err != nil {
+		msg := fmt.Sprintf("bad json in request: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, "bad request", code)
+		return
+	}
+
+	rev, err := newRevocation(conf, p, un)
+	if err != nil {
+		msg := fmt.Sprintf("validation failure: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+
+	err = dbAddRevocation(conf, rev)
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+
+	// Log the request
+	code := http.StatusOK
+	msg := fmt.Sprintf("revoked %s[%s] ca[%s] reason[%s]", rev.Type, rev.Value, rev.CA, rev.Reason)
+	logger.audit(un, code, msg, auditInfo{Event: eventRevocation, Level: "warning"})
+
+	fmt.Fprintln(w, msg)
+}
+
+func krlHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	krl, err := genKRL(conf)
+	if err != nil {
+		log.Printf("failed to generate krl: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(krl)
+}
@@ -30,6 +30,17 @@ else
     echo "SSH CA keypair already exists. Skipping generation."
 fi
 
+# Generate SSH host CA keypair
+if [ ! -e "$CURSE_ROOT/etc/host_ca" ] || [ ! -e "$CURSE_ROOT/etc/host_ca.pub" ]; then
+    echo "Generating $CURSE_ALGO SSH host CA certificates..."
+    ssh-keygen -q -N "" -t "$CURSE_ALGO" -f "$CURSE_ROOT/etc/host_ca"
+    chmod 600 "$CURSE_ROOT/etc/host_ca"
+    chmod 644 "$CURSE_ROOT/etc/host_ca.pub"
+    echo "$CURSE_ALGO SSH host CA keypair generated. It can be found at $CURSE_ROOT/etc/host_ca.pub"
+else
+    echo "SSH host CA keypair already exists. Skipping generation."
+fi
+
 # Fix curse permissions
 chown -R curse. "$CURSE_ROOT"
 /usr/bin/env setcap 'cap_net_bind_service=+ep' /opt/curse/sbin/cursed
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// CA signer backends
+const (
+	caBackendFile   = "file"
+	caBackendAgent  = "agent"
+	caBackendRemote = "remote"
+)
+
+// agentSigner signs with a CA key held in an ssh-agent, so the private key never enters cursed
+type agentSigner struct {
+	pub    ssh.PublicKey
+	socket string
+}
+
+func newAgentSigner(socket string, pub ssh.PublicKey) (*agentSigner, error) {
+	if socket == "" {
+		return nil, fmt.Errorf("caagentsocket is required for the agent ca backend")
+	}
+	s := &agentSigner{pub: pub, socket: socket}
+
+	// Make sure the agent actually holds our CA key
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ssh-agent keys: %v", err)
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), pub.Marshal()) {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("ssh-agent does not hold ca key %s", ssh.FingerprintSHA256(pub))
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	// Connect per signature so an agent restart doesn't leave us with a dead connection
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+	defer conn.Close()
+
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+
+	return agent.NewClient(conn).SignWithFlags(s.pub, data, flags)
+}
+
+// remoteSigner sends signing operations to a remote signing service over HTTP
+type remoteSigner struct {
+	client *http.Client
+	pub    ssh.PublicKey
+	token  string
+	url    string
+}
+
+type remoteSignRequest struct {
+	Algorithm string `json:"algorithm,omitempty"`
+	Data      string `json:"data"`
+	PublicKey string `json:"public_key"`
+}
+
+type remoteSignResponse struct {
+	Blob   string `json:"blob"`
+	Format string `json:"format"`
+	Rest   string `json:"rest,omitempty"`
+}
+
+func newRemoteSigner(conf *config, pub ssh.PublicKey) (*remoteSigner, error) {
+	if conf.CARemoteURL == "" {
+		return nil, fmt.Errorf("caremoteurl is required for the remote ca backend")
+	}
+
+	// Our bearer token and the data we sign must not cross the network in the clear
+	u, err := url.Parse(conf.CARemoteURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid caremoteurl: %v", err)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !isLoopback(u.Hostname()) {
+			return nil, fmt.Errorf("caremoteurl must use https unless the signer is on localhost: %s", conf.CARemoteURL)
+		}
+	default:
+		return nil, fmt.Errorf("caremoteurl must be an http or https url: %s", conf.CARemoteURL)
+	}
+
+	s := &remoteSigner{
+		client: &http.Client{Timeout: time.Duration(conf.CARemoteTimeout) * time.Second},
+		pub:    pub,
+		token:  conf.CARemoteToken,
+		url:    conf.CARemoteURL,
+	}
+
+	return s, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *remoteSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *remoteSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *remoteSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	pl, err := json.Marshal(remoteSignRequest{
+		Algorithm: algorithm,
+		Data:      base64.StdEncoding.EncodeToString(data),
+		PublicKey: base64.StdEncoding.EncodeToString(s.pub.Marshal()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal remote signing request: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewBuffer(pl))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build remote signing request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("remote signer connection failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote signer response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote signer returned %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var rs remoteSignResponse
+	err = json.Unmarshal(body, &rs)
+	if err != nil {
+		return nil, fmt.Errorf("bad json in remote signer response: %v", err)
+	}
+	sig := &ssh.Signature{Format: rs.Format}
+	sig.Blob, err = base64.StdEncoding.DecodeString(rs.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("bad signature blob in remote signer response: %v", err)
+	}
+	if rs.Rest != "" {
+		sig.Rest, err = base64.StdEncoding.DecodeString(rs.Rest)
+		if err != nil {
+			return nil, fmt.Errorf("bad signature data in remote signer response: %v", err)
+		}
+	}
+
+	// Never hand out a certificate with a signature that doesn't verify
+	err = s.pub.Verify(data, sig)
+	if err != nil {
+		return nil, fmt.Errorf("remote signer returned an invalid signature: %v", err)
+	}
+
+	return sig, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestRemoteSigner serves signatures from ca, and records the token each request carried
+func newTestRemoteSigner(t *testing.T, ca ssh.Signer, tls bool, tokens *[]string) *httptest.Server {
+	t.Helper()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*tokens = append(*tokens, r.Header.Get("Authorization"))
+
+		var req remoteSignRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.PublicKey != base64.StdEncoding.EncodeToString(ca.PublicKey().Marshal()) {
+			http.Error(w, "unknown key", http.StatusNotFound)
+			return
+		}
+		data, _ := base64.StdEncoding.DecodeString(req.Data)
+
+		sig, err := ca.Sign(rand.Reader, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(remoteSignResponse{
+			Blob:   base64.StdEncoding.EncodeToString(sig.Blob),
+			Format: sig.Format,
+		})
+	})
+
+	var ts *httptest.Server
+	if tls {
+		ts = httptest.NewTLSServer(h)
+	} else {
+		ts = httptest.NewServer(h)
+	}
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestRemoteSignerURLs(t *testing.T) {
+	pub := newTestSigner(t).PublicKey()
+
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://signer.example.com/sign", true},
+		{"http://127.0.0.1:8080/sign", true},
+		{"http://[::1]:8080/sign", true},
+		{"http://localhost/sign", true},
+		{"http://signer.example.com/sign", false},
+		{"http://10.0.0.1/sign", false},
+		{"ftp://signer.example.com/sign", false},
+	}
+	for _, tt := range tests {
+		_, err := newRemoteSigner(&config{CARemoteURL: tt.url}, pub)
+		if (err == nil) != tt.ok {
+			t.Errorf("newRemoteSigner(%s): got error %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestRemoteSignerSigns(t *testing.T) {
+	ca := newTestSigner(t)
+
+	for _, tls := range []bool{false, true} {
+		var tokens []string
+		ts := newTestRemoteSigner(t, ca, tls, &tokens)
+
+		s, err := newRemoteSigner(&config{CARemoteToken: "s3cret", CARemoteTimeout: 5, CARemoteURL: ts.URL}, ca.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tls {
+			s.client = ts.Client()
+		}
+
+		// Sign a certificate through the remote signer, and check it against the CA
+		cert := &ssh.Certificate{
+			CertType:    ssh.UserCert,
+			Key:         newTestSigner(t).PublicKey(),
+			KeyId:       "test",
+			ValidBefore: ssh.CertTimeInfinity,
+		}
+		err = cert.SignCert(rand.Reader, s)
+		if err != nil {
+			t.Fatalf("tls %v: SignCert: %v", tls, err)
+		}
+		checker := &ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		}}
+		err = checker.CheckCert("", cert)
+		if err != nil {
+			t.Errorf("tls %v: remotely signed certificate doesn't verify: %v", tls, err)
+		}
+		if len(tokens) != 1 || tokens[0] != "Bearer s3cret" {
+			t.Errorf("tls %v: signer got authorization headers %q", tls, tokens)
+		}
+	}
+}
+
+func TestRemoteSignerRejectsBadSignatures(t *testing.T) {
+	ca := newTestSigner(t)
+	var tokens []string
+	ts := newTestRemoteSigner(t, ca, false, &tokens)
+
+	// A signer holding a different key must not be trusted
+	s, err := newRemoteSigner(&config{CARemoteTimeout: 5, CARemoteURL: ts.URL}, newTestSigner(t).PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Sign(rand.Reader, []byte("data"))
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want the signer's 404", err)
+	}
+
+	s.pub = ca.PublicKey()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig, _ := newTestSigner(t).Sign(rand.Reader, []byte("data"))
+		json.NewEncoder(w).Encode(remoteSignResponse{
+			Blob:   base64.StdEncoding.EncodeToString(sig.Blob),
+			Format: sig.Format,
+		})
+	})
+	_, err = s.Sign(rand.Reader, []byte("data"))
+	if err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("got %v, want an invalid signature error", err)
+	}
+}
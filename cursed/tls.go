@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 )
 
 func getTLSConfig(conf *config) (*tls.Config, error) {
@@ -17,12 +20,41 @@ func getTLSConfig(conf *config) (*tls.Config, error) {
 	if ok := certPool.AppendCertsFromPEM(tlsCACert); !ok {
 		return nil, fmt.Errorf("could not import sslca certificate: %v", err)
 	}
+	conf.tlsCABundle = tlsCACert
+
+	// Keep a separate pool of only the user CA, so host identities can't be used to request
+	// user certificates
+	conf.tlsUserCAPool = x509.NewCertPool()
+	conf.tlsUserCAPool.AppendCertsFromPEM(tlsCACert)
+
+	// Add the host identity CA to the pool of accepted client CAs
+	if conf.HostSSLCA != "" {
+		hostCACert, err := ioutil.ReadFile(conf.HostSSLCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read hostsslca certificate: %v", err)
+		}
+
+		conf.tlsHostCAPool = x509.NewCertPool()
+		if ok := conf.tlsHostCAPool.AppendCertsFromPEM(hostCACert); !ok {
+			return nil, fmt.Errorf("could not import hostsslca certificate")
+		}
+
+		// Host identities must be issued by a different CA than user identities, otherwise any
+		// user could request a host certificate
+		if sharedCA(tlsCACert, hostCACert) {
+			return nil, fmt.Errorf("hostsslca must not contain the same ca as sslca")
+		}
+
+		certPool.AppendCertsFromPEM(hostCACert)
+	}
 
 	// Set our TLS config
 	tlsConf := &tls.Config{
+		Certificates:             []tls.Certificate{conf.tlsCert},
 		ClientAuth:               tls.VerifyClientCertIfGiven,
 		ClientCAs:                certPool,
 		MinVersion:               tls.VersionTLS12,
+		NextProtos:               []string{"h2", "http/1.1"},
 		PreferServerCipherSuites: true,
 
 		CipherSuites: []uint16{
@@ -43,3 +75,61 @@ func getTLSConfig(conf *config) (*tls.Config, error) {
 
 	return tlsConf, nil
 }
+
+func parsePEMCerts(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+func sharedCA(a, b []byte) bool {
+	// Compare public keys, so a re-issued copy of the same CA is caught too
+	for _, ca := range parsePEMCerts(a) {
+		for _, cb := range parsePEMCerts(b) {
+			if bytes.Equal(ca.RawSubjectPublicKeyInfo, cb.RawSubjectPublicKeyInfo) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func verifyClientCert(r *http.Request, pool *x509.CertPool) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("no client certificate provided")
+	}
+	if pool == nil {
+		return nil, fmt.Errorf("no ca configured for this client certificate type")
+	}
+
+	// Re-verify the client certificate against only the CA appropriate for this endpoint
+	cert := r.TLS.PeerCertificates[0]
+	opts := x509.VerifyOptions{
+		Intermediates: x509.NewCertPool(),
+		Roots:         pool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	_, err := cert.Verify(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
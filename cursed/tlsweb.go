@@ -4,27 +4,20 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
+	"time"
 )
 
 func tlsCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 	// Set up some useful info for logging
-	parts := strings.Split(r.RemoteAddr, ":")
-	if len(parts) == 0 {
-		log.Print("critical error, could not get client IP from request")
-		http.Error(w, "not authorized", http.StatusUnauthorized)
-		return
-	}
-	ip := parts[0]
+	ip := clientIP(r)
 	un := "-"
 
 	// Start up our logger
 	logger := newLog(conf, ip, "tls", "")
 
 	// Load our form parameters into a struct
-	p, err := getJSONParams(r)
+	p, err := getJSONParams(w, r, conf)
 	if err != nil {
 		msg := fmt.Sprintf("bad json in request: %v", err)
 		code := http.StatusBadRequest
@@ -36,12 +29,17 @@ func tlsCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 	// Update our logger
 	logger.rip = p.UserIP
 
+	// Limit requests from each client the bastion relays for, before we spend time checking passwords
+	if !limitClient(conf, w, logger, un, p.UserIP) {
+		return
+	}
+
 	// Get our user/pass from basic auth
 	user, pass, ok := r.BasicAuth()
 	if !ok {
 		msg := "client basic auth failure"
 		code := http.StatusUnauthorized
-		logger.req(un, code, msg)
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "no-credentials"})
 		http.Error(w, "not authorized", code)
 		return
 	}
@@ -49,14 +47,40 @@ func tlsCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 
 	// Check the credentials
 	ok, err = pwauth(conf, user, pass)
+	if err == errExecBusy {
+		msg := fmt.Sprintf("authentication deferred: %v", err)
+		code := http.StatusTooManyRequests
+		logger.req(un, code, msg)
+		tooManyRequests(w, time.Second)
+		return
+	}
 	if !ok {
 		msg := fmt.Sprintf("authorization failure: %v", err)
 		code := http.StatusUnauthorized
-		logger.req(un, code, msg)
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "bad-password"})
+		conf.webhooks.notify(webhookEvent{Type: eventAuthFailure, IP: ip, Reason: fmt.Sprint(err),
+			User: user, UserIP: p.UserIP})
 		http.Error(w, "not authorized", code)
 		return
 	}
 
+	// Refuse to issue certificates during a lockdown, except to the emergency group
+	err = checkLockdown(conf, user)
+	if _, ok := err.(*lockdownError); ok {
+		msg := fmt.Sprintf("lockdown: %v", err)
+		code := http.StatusServiceUnavailable
+		logger.req(un, code, msg)
+		http.Error(w, "certificate issuance is locked down", code)
+		return
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+
 	// Make sure we have everything we need from our parameters
 	err = validateTLSParams(p, conf)
 	if err != nil {
@@ -132,9 +156,36 @@ func tlsCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 	// Generate our log entry
 	keyID := fmt.Sprintf("user[%s] from[%s] serial[%d] fingerprint[%s]", p.BastionUser, p.UserIP, c.SerialNumber, fp)
 
+	// Record the certificate in our issuance ledger
+	rec := &issuedCert{
+		Type:        issuedTLS,
+		Serial:      c.SerialNumber.String(),
+		KeyID:       keyID,
+		Principals:  []string{c.Subject.CommonName},
+		ValidAfter:  c.NotBefore.UTC(),
+		ValidBefore: c.NotAfter.UTC(),
+		CA:          string(tlsCertFP(conf.tlsCACert)),
+		Fingerprint: string(fp),
+		Requester:   user,
+		BastionIP:   ip,
+		UserIP:      p.UserIP,
+		IssuedAt:    time.Now().UTC(),
+	}
+	err = dbAddIssuedCert(conf, rec)
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+
 	// Log the request
 	code := http.StatusOK
-	logger.req(un, code, keyID)
+	logger.audit(un, code, keyID, auditInfo{Event: eventTLSCertIssued, Fingerprint: string(fp), KeyID: keyID,
+		Principal: c.Subject.CommonName})
+	conf.webhooks.notify(webhookEvent{Type: eventTLSCertIssued, Fingerprint: string(fp), IP: ip, KeyID: keyID,
+		User: user, UserIP: p.UserIP})
 
 	w.Write(cert)
 }
@@ -6,28 +6,40 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 type httpParams struct {
-	BastionIP   string `json:"bastion_ip,omitempty"`
-	BastionUser string `json:"bastion_user,omitempty"`
-	Cmd         string `json:"cmd,omitempty"`
-	CSR         string `json:"csr,omitempty"`
-	Key         string `json:"key,omitempty"`
-	RemoteUser  string `json:"remote_user,omitempty"`
-	UserIP      string `json:"user_ip,omitempty"`
+	BastionIP   string   `json:"bastion_ip,omitempty"`
+	BastionUser string   `json:"bastion_user,omitempty"`
+	BreakGlass  bool     `json:"break_glass,omitempty"`
+	CA          string   `json:"ca,omitempty"`
+	Cmd         string   `json:"cmd,omitempty"`
+	CSR         string   `json:"csr,omitempty"`
+	Decision    string   `json:"decision,omitempty"`
+	Duration    int      `json:"duration,omitempty"`
+	Extensions  []string `json:"extensions,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Hostnames   []string `json:"hostnames,omitempty"`
+	Key         string   `json:"key,omitempty"`
+	KeyID       string   `json:"key_id,omitempty"`
+	Nonce       string   `json:"nonce,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+	RemoteUser  string   `json:"remote_user,omitempty"`
+	Serial      uint64   `json:"serial,omitempty"`
+	Signature   string   `json:"signature,omitempty"`
+	UserIP      string   `json:"user_ip,omitempty"`
 
 	user string
 }
 
-func getJSONParams(r *http.Request) (httpParams, error) {
+func getJSONParams(w http.ResponseWriter, r *http.Request, conf *config) (httpParams, error) {
 	var p httpParams
 
-	body, err := ioutil.ReadAll(r.Body)
+	// Cap the body size here too, so handlers are covered even without limitRequests in front of them
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, conf.MaxRequestBytes))
 	if err != nil {
 		return p, err
 	}
@@ -43,20 +55,14 @@ func getJSONParams(r *http.Request) (httpParams, error) {
 
 func sshCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 	// Set up some useful info for logging
-	parts := strings.Split(r.RemoteAddr, ":")
-	if len(parts) == 0 {
-		log.Print("critical error, could not get client IP from request")
-		http.Error(w, "not authorized", http.StatusUnauthorized)
-		return
-	}
-	ip := parts[0]
+	ip := clientIP(r)
 	un := "-"
 
 	// Start up our logger
 	logger := newLog(conf, ip, "ssh", "")
 
 	// Load our form parameters into a struct
-	p, err := getJSONParams(r)
+	p, err := getJSONParams(w, r, conf)
 	if err != nil {
 		msg := fmt.Sprintf("bad json in request: %v", err)
 		code := http.StatusBadRequest
@@ -72,13 +78,25 @@ func sshCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 	if len(r.TLS.VerifiedChains) == 0 {
 		msg := "no valid client certificate provided"
 		code := http.StatusUnauthorized
-		logger.req(un, code, msg)
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "no-client-cert"})
+		conf.webhooks.notify(webhookEvent{Type: eventAuthFailure, IP: ip, Reason: msg, UserIP: p.UserIP})
+		http.Error(w, "not authorized", code)
+		return
+	}
+
+	// Make sure this is a user identity and not a host identity
+	clientCert, err := verifyClientCert(r, conf.tlsUserCAPool)
+	if err != nil {
+		msg := fmt.Sprintf("client certificate not issued by user ca: %v", err)
+		code := http.StatusUnauthorized
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Reason: "wrong-ca"})
+		conf.webhooks.notify(webhookEvent{Type: eventAuthFailure, IP: ip, Reason: msg, UserIP: p.UserIP})
 		http.Error(w, "not authorized", code)
 		return
 	}
 
 	// Get the client certificate CN
-	p.user = r.TLS.PeerCertificates[0].Subject.CommonName
+	p.user = clientCert.Subject.CommonName
 	un = p.user
 
 	// Make sure we have everything we need from our parameters
@@ -91,9 +109,27 @@ func sshCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 		return
 	}
 
-	// Set our certificate validity times
-	va := time.Now().Add(-30 * time.Second)
-	vb := time.Now().Add(conf.dur)
+	// Limit requests from each client the bastion relays for
+	if !limitClient(conf, w, logger, un, p.UserIP) {
+		return
+	}
+
+	// Refuse to issue certificates during a lockdown, except to the emergency group
+	err = checkLockdown(conf, p.user)
+	if _, ok := err.(*lockdownError); ok {
+		msg := fmt.Sprintf("lockdown: %v", err)
+		code := http.StatusServiceUnavailable
+		logger.req(un, code, msg)
+		http.Error(w, "certificate issuance is locked down", code)
+		return
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
 
 	// Generate a fingerprint of the received public key for our key_id string
 	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.Key))
@@ -104,43 +140,224 @@ func sshCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 		http.Error(w, msg, code)
 		return
 	}
-	// Using md5 because that's what ssh-keygen prints out, making searches for a particular key easier
-	fp := ssh.FingerprintLegacyMD5(pk)
+	// Using SHA256 because that's what ssh-keygen and sshd print out, making searches for a particular key easier
+	fp := ssh.FingerprintSHA256(pk)
 
-	// Generate our key_id for the certificate
-	keyID := fmt.Sprintf("user[%s] from[%s] command[%s] sshKey[%s] ca[%s] valid to[%s]",
-		p.user, p.UserIP, p.Cmd, fp, conf.sshCAFP, vb.Format(time.RFC3339))
+	// Make sure the pubkey meets our algorithm and strength requirements
+	err = conf.keyPolicy.check(pk)
+	if err != nil {
+		msg := fmt.Sprintf("pubkey rejected: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+
+	// Privileged principals may require a hardware-backed security key
+	verifyRequired, err := checkSecurityKey(conf, p.RemoteUser, pk)
+	if err != nil {
+		msg := fmt.Sprintf("pubkey rejected: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+
+	// Make sure the client holds the private key for the submitted pubkey
+	if conf.RequireKeyProof || p.Nonce != "" {
+		err = verifyKeyProof(conf, pk, p)
+		if err != nil {
+			msg := fmt.Sprintf("key proof failed: user[%s] pubkey[%s]: %v", p.user, fp, err)
+			code := http.StatusForbidden
+			logger.audit(un, code, msg, auditInfo{Event: eventAuthFailure, Fingerprint: fp, Principal: p.RemoteUser,
+				Reason: "key-proof-failed"})
+			http.Error(w, fmt.Sprintf("key proof failed: %v", err), code)
+			return
+		}
+	} else {
+		// Let admins find the clients that need upgrading before they turn requirekeyproof back on
+		log.Printf("pubkey submitted without key proof: user[%s] pubkey[%s] ip[%s] userIP[%s]", p.user, fp, ip, p.UserIP)
+	}
+
+	// Refuse to certify revoked pubkeys
+	revoked, err := pubKeyRevoked(conf, pk)
+	if err != nil {
+		msg := fmt.Sprintf("failed to check pubkey revocation: %v", err)
+		code := http.StatusInternalServerError
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+	if revoked {
+		msg := fmt.Sprintf("pubkey revoked: user[%s] pubkey[%s]", p.user, fp)
+		code := http.StatusForbidden
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Fingerprint: fp, Principal: p.RemoteUser,
+			Reason: "pubkey-revoked"})
+		http.Error(w, "submitted pubkey has been revoked", code)
+		return
+	}
 
-	// Check if user is authorized for this principal
-	err = unixgroup(conf, p.user, p.RemoteUser)
+	// Check if user is authorized for this principal. Break-glass requests skip the group checks,
+	// for when the authz backend is down
+	var rule *aclRule
+	if p.BreakGlass {
+		err = checkBreakGlass(conf, p.user, p.RemoteUser)
+	} else if conf.policy != nil {
+		rule, err = conf.policy.match(conf, p.user, p.RemoteUser)
+	} else {
+		err = unixgroup(conf, p.user, p.RemoteUser)
+	}
+	if err == errExecBusy {
+		msg := fmt.Sprintf("authorization deferred: %v", err)
+		code := http.StatusTooManyRequests
+		logger.req(un, code, msg)
+		tooManyRequests(w, time.Second)
+		return
+	}
 	if err != nil {
 		msg := fmt.Sprintf("authorization failure: %v", err)
 		code := http.StatusUnauthorized
-		logger.req(un, code, msg)
+		reason := "principal-not-allowed"
+		if p.BreakGlass {
+			reason = "break-glass-not-allowed"
+		}
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Fingerprint: fp, Principal: p.RemoteUser,
+			Reason: reason})
+		conf.webhooks.notify(webhookEvent{Type: eventAuthzDenied, BreakGlass: p.BreakGlass, IP: ip,
+			Principal: p.RemoteUser, Reason: err.Error(), User: p.user, UserIP: p.UserIP})
 		http.Error(w, "not authorized", code)
 		return
 	}
 
-	// Check if we've seen this pubkey before and if it's too old
-	expired, err := checkPubKeyAge(conf, fp)
+	// Check if we've seen this pubkey before, who it belongs to, and if it's too old
+	expired, err := checkPubKeyAge(conf, pk, p.user)
+	if _, ok := err.(*pubKeyOwnerError); ok {
+		code := http.StatusForbidden
+		msg := fmt.Sprintf("SECURITY pubkey owner mismatch: %v", err)
+		logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Fingerprint: fp, Level: "critical",
+			Principal: p.RemoteUser, Reason: "pubkey-owner-mismatch"})
+		http.Error(w, "submitted pubkey is registered to another user", code)
+		return
+	}
 	if expired {
 		code := http.StatusUnprocessableEntity
 		msg := fmt.Sprintf("pubkey expired: user[%s] pubkey[%s]: %v", p.user, fp, err)
-		logger.req(un, code, msg)
+		logger.audit(un, code, msg, auditInfo{Event: eventPubKeyExpired, Fingerprint: fp, Principal: p.RemoteUser,
+			Reason: "pubkey-expired"})
+		conf.webhooks.notify(webhookEvent{Type: eventPubKeyExpired, Fingerprint: fp, IP: ip,
+			Principal: p.RemoteUser, User: p.user, UserIP: p.UserIP})
 		http.Error(w, "submitted pubkey is too old. Please generate new key.", code)
 		return
 	}
 
+	// Clamp the client's requested duration and extensions to what this principal permits
+	baseExts := conf.exts
+	if rule != nil && rule.hasExts {
+		baseExts = rule.exts
+	}
+	dur, exts, notices, err := clampRequest(conf, p, baseExts)
+	if err != nil {
+		msg := fmt.Sprintf("validation failure: %v", err)
+		code := http.StatusBadRequest
+		logger.req(un, code, msg)
+		http.Error(w, msg, code)
+		return
+	}
+
+	// Break-glass certificates are kept short
+	if p.BreakGlass && dur > conf.breakGlassDur {
+		notices = append(notices, fmt.Sprintf("duration reduced to break-glass maximum of %v", conf.breakGlassDur))
+		dur = conf.breakGlassDur
+	}
+
+	// Set our certificate validity times
+	va := time.Now().Add(-30 * time.Second)
+	vb := time.Now().Add(dur)
+
 	// Set all of our certificate options
 	cc := certConfig{
-		certType:    ssh.UserCert,
-		command:     p.Cmd,
-		extensions:  conf.exts,
-		keyID:       keyID,
-		principals:  []string{p.RemoteUser},
-		srcAddr:     p.BastionIP,
-		validAfter:  va,
-		validBefore: vb,
+		acl:            rule,
+		certType:       ssh.UserCert,
+		command:        p.Cmd,
+		extensions:     exts,
+		principals:     []string{p.RemoteUser},
+		requester:      p.user,
+		srcAddr:        p.BastionIP,
+		userIP:         p.UserIP,
+		validAfter:     va,
+		validBefore:    vb,
+		verifyRequired: verifyRequired,
+	}
+
+	// Apply the policy rule's restrictions before generating our key_id
+	if rule != nil {
+		err = rule.apply(&cc)
+		if err != nil {
+			msg := fmt.Sprintf("authorization failure: %v", err)
+			code := http.StatusForbidden
+			logger.audit(un, code, msg, auditInfo{Event: eventAuthzDenied, Fingerprint: fp, Principal: p.RemoteUser,
+				Reason: "policy-restriction"})
+			conf.webhooks.notify(webhookEvent{Type: eventAuthzDenied, IP: ip, Principal: p.RemoteUser,
+				Reason: err.Error(), User: p.user, UserIP: p.UserIP})
+			http.Error(w, "not authorized", code)
+			return
+		}
+		if cc.validBefore.Before(vb) {
+			notices = append(notices, fmt.Sprintf("duration reduced to maximum of %v by policy rule %q",
+				rule.maxDur, rule.Name))
+		}
+	}
+
+	// Generate our key_id for the certificate
+	kc := keyIDContext{
+		BastionIP:   p.BastionIP,
+		CA:          string(conf.sshCA.activeFP()),
+		Command:     cc.command,
+		Principals:  cc.principals,
+		SSHKey:      fp,
+		Type:        "user",
+		User:        p.user,
+		UserIP:      p.UserIP,
+		ValidBefore: cc.validBefore.Truncate(time.Second),
+	}
+	if conf.LegacyFingerprints {
+		// Include the old MD5 format until log searches have moved over to SHA256
+		kc.SSHKeyMD5 = ssh.FingerprintLegacyMD5(pk)
+	}
+	cc.keyID, err = kc.format(conf)
+	if err != nil {
+		code := http.StatusInternalServerError
+		msg := err.Error()
+		logger.req(un, code, msg)
+		http.Error(w, "server error", code)
+		return
+	}
+
+	// Privileged principals need a second person to approve the request before we sign it, unless
+	// this is a break-glass request
+	if approvalRequired(conf, p.RemoteUser) && !p.BreakGlass {
+		ar, err := newApproval(conf, p.Key, &cc, kc)
+		if err != nil {
+			code := http.StatusInternalServerError
+			msg := err.Error()
+			logger.req(un, code, msg)
+			http.Error(w, "server error", code)
+			return
+		}
+
+		code := http.StatusAccepted
+		logger.audit(un, code, fmt.Sprintf("approval required: request[%s] %s", ar.ID, cc.keyID),
+			auditInfo{Command: cc.command, Event: eventApprovalRequested, Fingerprint: fp, KeyID: cc.keyID,
+				Principal: p.RemoteUser})
+
+		for _, notice := range notices {
+			w.Header().Add("X-Curse-Notice", notice)
+		}
+		w.Header().Set("Location", "/approvals/"+ar.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(ar)
+		return
 	}
 
 	// Sign the public key
@@ -153,9 +370,25 @@ func sshCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 		return
 	}
 
-	// Log the request
+	// Log the request, calling out break-glass certificates now they've actually been issued
 	code := http.StatusOK
-	logger.req(un, code, keyID)
+	issued := auditInfo{Command: cc.command, Event: eventSSHCertIssued, Fingerprint: fp, KeyID: cc.keyID,
+		Principal: p.RemoteUser}
+	if p.BreakGlass {
+		issued.Level = "critical"
+		issued.Reason = "break-glass"
+		logger.audit(un, code, fmt.Sprintf("CRITICAL break-glass: user[%s] principal[%s] pubkey[%s] %s",
+			p.user, p.RemoteUser, fp, cc.keyID), issued)
+	} else {
+		logger.audit(un, code, cc.keyID, issued)
+	}
+	conf.webhooks.notify(webhookEvent{Type: eventSSHCertIssued, BreakGlass: p.BreakGlass, CertType: "user",
+		Fingerprint: fp, IP: ip, KeyID: cc.keyID, Principal: p.RemoteUser, User: p.user, UserIP: p.UserIP})
+
+	// Explain any changes made to what the client asked for
+	for _, notice := range notices {
+		w.Header().Add("X-Curse-Notice", notice)
+	}
 
 	// Return the cert
 	w.Write(authorizedKey)
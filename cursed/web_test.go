@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestHandlerConf sets up a config that lets any user with a client certificate from ca ask for root
+func newTestHandlerConf(t *testing.T, ca *testUserCA) *config {
+	t.Helper()
+
+	conf := newTestConf(t)
+	conf.aliases = &principalAliases{exact: map[string][]string{"root": {"*"}}}
+	conf.challenges = newChallengeStore(time.Minute)
+	conf.dur = 2 * time.Minute
+	conf.keyLifeSpan = time.Hour
+	conf.maxDur = time.Hour
+	conf.MaxRequestBytes = 64 * 1024
+	conf.RequireKeyProof = true
+	conf.tlsUserCAPool = ca.pool
+
+	var err error
+	conf.keyPolicy, err = newKeyPolicy([]string{"ed25519"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conf
+}
+
+func testCertRequest(t *testing.T, conf *config, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	sshCertHandler(w, r, conf)
+
+	return w
+}
+
+func TestSSHCertKeyProof(t *testing.T) {
+	ca := newTestUserCA(t)
+	conf := newTestHandlerConf(t, ca)
+	key := newTestSigner(t)
+	other := newTestSigner(t)
+
+	params := func(nonce, sig string) httpParams {
+		return httpParams{
+			BastionIP:  "10.0.0.1",
+			Key:        string(ssh.MarshalAuthorizedKey(key.PublicKey())),
+			Nonce:      nonce,
+			RemoteUser: "root",
+			Signature:  sig,
+		}
+	}
+	nonce := func(user string) string {
+		n, _, err := conf.challenges.issue(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// A proof from the key's holder gets a certificate, but the nonce can't be used again
+	n := nonce("alice")
+	p := params(n, signTestProof(t, key, n))
+	w := testCertRequest(t, conf, ca.request(t, "alice", "POST", "/", p))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want a certificate", w.Code, w.Body)
+	}
+	w = testCertRequest(t, conf, ca.request(t, "alice", "POST", "/", p))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "already used") {
+		t.Errorf("reused nonce: got %d %s", w.Code, w.Body)
+	}
+
+	stolen, wrong := nonce("alice"), nonce("alice")
+	tests := []struct {
+		name string
+		user string
+		p    httpParams
+		want string
+	}{
+		{"missing nonce", "alice", params("", ""), "nonce and signature are required"},
+		{"missing signature", "alice", params(nonce("alice"), ""), "nonce and signature are required"},
+		{"unknown nonce", "alice", params("made-up", signTestProof(t, key, "made-up")), "unknown or already used nonce"},
+		{"another user's nonce", "mallory", params(stolen, signTestProof(t, key, stolen)), "nonce was issued to alice"},
+		{"wrong key", "alice", params(wrong, signTestProof(t, other, wrong)), "signature does not match pubkey"},
+		{"bad signature", "alice", params(nonce("alice"), "bm90IGEgc2lnbmF0dXJl"), "failed to parse signature"},
+	}
+	for _, tt := range tests {
+		w := testCertRequest(t, conf, ca.request(t, tt.user, "POST", "/", tt.p))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: got %d %s, want 403 %q", tt.name, w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+		}
+	}
+
+	// Without requirekeyproof, requests without a proof get through but proofs that are sent are still checked
+	conf.RequireKeyProof = false
+	w = testCertRequest(t, conf, ca.request(t, "alice", "POST", "/", params("", "")))
+	if w.Code != http.StatusOK {
+		t.Errorf("request without proof: got %d %s", w.Code, w.Body)
+	}
+	n = nonce("alice")
+	w = testCertRequest(t, conf, ca.request(t, "alice", "POST", "/", params(n, signTestProof(t, other, n))))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("bad proof with requirekeyproof off: got %d %s", w.Code, w.Body)
+	}
+}
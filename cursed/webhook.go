@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	eventAuthFailure   = "auth-failure"
+	eventAuthzDenied   = "authz-denied"
+	eventPubKeyExpired = "pubkey-expired"
+	eventSSHCertIssued = "ssh-cert-issued"
+	eventTLSCertIssued = "tls-cert-issued"
+)
+
+var (
+	webhookEventTypes = map[string]bool{
+		eventAuthFailure:   true,
+		eventAuthzDenied:   true,
+		eventPubKeyExpired: true,
+		eventSSHCertIssued: true,
+		eventTLSCertIssued: true,
+	}
+	webhookNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+type webhookEvent struct {
+	BreakGlass  bool      `json:"break_glass,omitempty"`
+	CertType    string    `json:"cert_type,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	ID          string    `json:"id"`
+	IP          string    `json:"ip"`
+	KeyID       string    `json:"key_id,omitempty"`
+	Principal   string    `json:"principal,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	User        string    `json:"user,omitempty"`
+	UserIP      string    `json:"user_ip,omitempty"`
+}
+
+type webhook struct {
+	Events     []string
+	Name       string
+	Principals []string
+	Secret     string
+	Timeout    int
+	URL        string
+
+	client   *http.Client
+	events   map[string]bool
+	inflight []byte
+	mu       sync.Mutex
+	queue    chan []byte
+	spool    string
+}
+
+type webhookNotifier struct {
+	hooks   []*webhook
+	retries int
+}
+
+func newWebhookNotifier(conf *config) (*webhookNotifier, error) {
+	if len(conf.Webhooks) == 0 {
+		return nil, nil
+	}
+
+	wn := &webhookNotifier{retries: conf.WebhookRetries}
+	names := make(map[string]bool)
+	for _, h := range conf.Webhooks {
+		if h == nil || h.URL == "" {
+			return nil, fmt.Errorf("webhooks require a url")
+		}
+		if !webhookNameRegex.MatchString(h.Name) {
+			return nil, fmt.Errorf("invalid webhook name (letters, numbers, - and _ only): %q", h.Name)
+		}
+		if names[h.Name] {
+			return nil, fmt.Errorf("duplicate webhook name: %s", h.Name)
+		}
+		names[h.Name] = true
+
+		// Receivers can't tell our events from anyone else's without a signature
+		if h.Secret == "" {
+			return nil, fmt.Errorf("webhook %s requires a secret", h.Name)
+		}
+
+		h.events = make(map[string]bool)
+		for _, e := range h.Events {
+			if !webhookEventTypes[e] {
+				return nil, fmt.Errorf("invalid event type for webhook %s: %s", h.Name, e)
+			}
+			h.events[e] = true
+		}
+		for _, p := range h.Principals {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid principal pattern for webhook %s: %s", h.Name, p)
+			}
+		}
+
+		if h.Timeout <= 0 {
+			h.Timeout = 10
+		}
+		h.client = &http.Client{Timeout: time.Duration(h.Timeout) * time.Second}
+		h.queue = make(chan []byte, 256)
+
+		// Each webhook spools undeliverable events to its own directory
+		h.spool = filepath.Join(conf.WebhookSpoolDir, h.Name)
+		err := os.MkdirAll(h.spool, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create webhook spool directory: %v", err)
+		}
+
+		wn.hooks = append(wn.hooks, h)
+	}
+
+	return wn, nil
+}
+
+func (wn *webhookNotifier) start() {
+	if wn == nil {
+		return
+	}
+
+	for _, h := range wn.hooks {
+		go h.deliver(wn.retries)
+		go h.replaySpool()
+	}
+}
+
+func (wn *webhookNotifier) notify(ev webhookEvent) {
+	if wn == nil {
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	ev.ID = hex.EncodeToString(b)
+	ev.Time = time.Now().UTC()
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("failed to encode webhook event: %v", err)
+		return
+	}
+
+	for _, h := range wn.hooks {
+		if !h.wants(ev) {
+			continue
+		}
+
+		// Never hold up a request on a webhook, spool the event if the queue is backed up
+		select {
+		case h.queue <- body:
+		default:
+			h.spoolEvent(ev.ID, body)
+		}
+	}
+}
+
+func (wn *webhookNotifier) spoolQueued() {
+	if wn == nil {
+		return
+	}
+
+	// Save anything still waiting to be delivered, so it's replayed after we restart. That includes
+	// the event being retried, which may then be delivered twice. Receivers can tell by its id
+	for _, h := range wn.hooks {
+		h.mu.Lock()
+		if h.inflight != nil {
+			var ev webhookEvent
+			json.Unmarshal(h.inflight, &ev)
+			h.spoolEvent(ev.ID, h.inflight)
+		}
+		h.mu.Unlock()
+	drain:
+		for {
+			select {
+			case body := <-h.queue:
+				var ev webhookEvent
+				json.Unmarshal(body, &ev)
+				h.spoolEvent(ev.ID, body)
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+func (h *webhook) wants(ev webhookEvent) bool {
+	if len(h.events) > 0 && !h.events[ev.Type] {
+		return false
+	}
+	if len(h.Principals) == 0 {
+		return true
+	}
+	for _, p := range h.Principals {
+		if ok, _ := path.Match(p, ev.Principal); ok && ev.Principal != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *webhook) send(body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Sign the body so receivers can tell the event came from us
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	req.Header.Set("X-Curse-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded with status %d", h.Name, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (h *webhook) deliver(retries int) {
+	for body := range h.queue {
+		h.mu.Lock()
+		h.inflight = body
+		h.mu.Unlock()
+
+		var err error
+		for attempt := 0; attempt <= retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+			}
+			err = h.send(body)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("webhook %s delivery failed, spooling event: %v", h.Name, err)
+			var ev webhookEvent
+			json.Unmarshal(body, &ev)
+			h.spoolEvent(ev.ID, body)
+		}
+
+		h.mu.Lock()
+		h.inflight = nil
+		h.mu.Unlock()
+	}
+}
+
+func (h *webhook) spoolEvent(id string, body []byte) {
+	// Write to a temp file first so the replayer never picks up a partial event
+	name := filepath.Join(h.spool, id+".json")
+	err := ioutil.WriteFile(name+".tmp", body, 0600)
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		log.Printf("webhook %s failed to spool event %s: %v", h.Name, id, err)
+	}
+}
+
+func (h *webhook) replaySpool() {
+	for {
+		h.replaySpoolOnce()
+		time.Sleep(time.Minute)
+	}
+}
+
+func (h *webhook) replaySpoolOnce() {
+	files, err := filepath.Glob(filepath.Join(h.spool, "*.json"))
+	if err != nil {
+		log.Printf("webhook %s failed to read spool: %v", h.Name, err)
+	}
+	for _, f := range files {
+		body, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		err = h.send(body)
+		if err != nil {
+			// Leave the rest for next time, the receiver is probably still down
+			return
+		}
+		os.Remove(f)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testReceiver records the events a webhook delivers, failing the first fail requests (all of them
+// when fail is negative)
+type testReceiver struct {
+	mu     sync.Mutex
+	fail   int
+	events []webhookEvent
+	sigs   []string
+	got    chan struct{}
+}
+
+func newTestReceiver(t *testing.T, fail int) (*testReceiver, *httptest.Server) {
+	t.Helper()
+
+	tr := &testReceiver{fail: fail, got: make(chan struct{}, 16)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+
+		if tr.fail != 0 {
+			tr.fail--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		var ev webhookEvent
+		json.Unmarshal(body, &ev)
+		tr.events = append(tr.events, ev)
+
+		// Keep the signature only if it matches the body we got
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		sig := r.Header.Get("X-Curse-Signature")
+		if sig == "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			tr.sigs = append(tr.sigs, sig)
+		}
+		tr.got <- struct{}{}
+	}))
+	t.Cleanup(ts.Close)
+
+	return tr, ts
+}
+
+func (tr *testReceiver) received() ([]webhookEvent, int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return append([]webhookEvent(nil), tr.events...), len(tr.sigs)
+}
+
+func newTestWebhooks(t *testing.T, url string, retries int) *webhookNotifier {
+	t.Helper()
+
+	wn, err := newWebhookNotifier(&config{
+		WebhookRetries:  retries,
+		WebhookSpoolDir: testTempDir(t),
+		Webhooks:        []*webhook{{Name: "test", Secret: "s3cret", URL: url}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wn
+}
+
+func spooled(t *testing.T, h *webhook) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(h.spool, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestWebhookConfig(t *testing.T) {
+	tests := []struct {
+		hook *webhook
+		ok   bool
+	}{
+		{&webhook{Name: "ok", Secret: "s3cret", URL: "https://hooks.example.com/"}, true},
+		{&webhook{Name: "nosecret", URL: "https://hooks.example.com/"}, false},
+		{&webhook{Name: "nourl", Secret: "s3cret"}, false},
+		{&webhook{Name: "bad/name", Secret: "s3cret", URL: "https://hooks.example.com/"}, false},
+		{&webhook{Name: "badevent", Events: []string{"nope"}, Secret: "s3cret", URL: "https://hooks.example.com/"}, false},
+	}
+	for _, tt := range tests {
+		_, err := newWebhookNotifier(&config{WebhookSpoolDir: testTempDir(t), Webhooks: []*webhook{tt.hook}})
+		if (err == nil) != tt.ok {
+			t.Errorf("webhook %s: got error %v, want ok %v", tt.hook.Name, err, tt.ok)
+		}
+	}
+}
+
+func TestWebhookDeliverySigned(t *testing.T) {
+	tr, ts := newTestReceiver(t, 0)
+	wn := newTestWebhooks(t, ts.URL, 0)
+	h := wn.hooks[0]
+	go h.deliver(wn.retries)
+	defer close(h.queue)
+
+	wn.notify(webhookEvent{Type: eventSSHCertIssued, Principal: "root", User: "alice"})
+	select {
+	case <-tr.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+
+	events, sigs := tr.received()
+	if len(events) != 1 || events[0].User != "alice" || events[0].ID == "" {
+		t.Errorf("got events %+v", events)
+	}
+	if sigs != 1 {
+		t.Error("event signature doesn't match the body")
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	// The first attempt fails, the retry gets through
+	tr, ts := newTestReceiver(t, 1)
+	wn := newTestWebhooks(t, ts.URL, 1)
+	h := wn.hooks[0]
+	go h.deliver(wn.retries)
+	defer close(h.queue)
+
+	wn.notify(webhookEvent{Type: eventAuthFailure, User: "mallory"})
+	select {
+	case <-tr.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not retried")
+	}
+	if events, _ := tr.received(); len(events) != 1 {
+		t.Errorf("got %d events, want 1", len(events))
+	}
+	if files := spooled(t, h); len(files) != 0 {
+		t.Errorf("delivered event was spooled: %v", files)
+	}
+}
+
+func TestWebhookSpoolReplay(t *testing.T) {
+	tr, ts := newTestReceiver(t, 2)
+	wn := newTestWebhooks(t, ts.URL, 0)
+	h := wn.hooks[0]
+
+	// With retries off, an event the receiver turns away is spooled straight away
+	go h.deliver(wn.retries)
+	wn.notify(webhookEvent{Type: eventSSHCertIssued, User: "alice"})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spooled(t, h)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(h.queue)
+	h.spoolEvent("second", []byte(`{"id":"second","type":"ssh-cert-issued","user":"bob"}`))
+	if files := spooled(t, h); len(files) != 2 {
+		t.Fatalf("got spool %v, want 2 events", files)
+	}
+
+	// The receiver is still down for one more request, so nothing is replayed yet
+	h.replaySpoolOnce()
+	if files := spooled(t, h); len(files) != 2 {
+		t.Fatalf("events removed from the spool without being delivered: %v", files)
+	}
+
+	h.replaySpoolOnce()
+	if files := spooled(t, h); len(files) != 0 {
+		t.Errorf("replayed events left in the spool: %v", files)
+	}
+	events, sigs := tr.received()
+	if len(events) != 2 || sigs != 2 {
+		t.Errorf("got %d events with %d good signatures, want 2", len(events), sigs)
+	}
+}
+
+func TestWebhookSpoolsInflightOnShutdown(t *testing.T) {
+	_, ts := newTestReceiver(t, -1)
+	wn := newTestWebhooks(t, ts.URL, 5)
+	h := wn.hooks[0]
+	go h.deliver(wn.retries)
+	defer close(h.queue)
+
+	// Wait for the event to be taken off the queue and retried
+	wn.notify(webhookEvent{Type: eventSSHCertIssued, User: "alice"})
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		inflight := h.inflight != nil
+		h.mu.Unlock()
+		if inflight {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wn.spoolQueued()
+	if files := spooled(t, h); len(files) != 1 {
+		t.Errorf("got spool %v, want the event being retried", files)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -41,6 +43,14 @@ func genTLSCACert(conf *config) error {
 		return fmt.Errorf("failed to generate ca cert: %v", err)
 	}
 
+	// Encrypt the CA key before it hits the disk if we have a passphrase for it
+	if conf.tlsKeyPass.configured() {
+		caKeyBytes, err = encryptPEMKey(caKey, conf.tlsKeyPass)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = ioutil.WriteFile(conf.SSLKey, caKeyBytes, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to write ca private key file: %v", err)
@@ -82,10 +92,12 @@ func signTLSClientCert(conf *config, csr *x509.CertificateRequest) ([]byte, []by
 	}
 
 	// Sign the CA cert
+	start := time.Now()
 	pemCert, rawCert, err := tlsSignCert(opts)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate client cert: %v", err)
 	}
+	conf.metrics.observeSign("tls", start)
 
 	return pemCert, rawCert, nil
 }
@@ -130,9 +142,18 @@ func loadTLSCA(conf *config) error {
 	if caKey == nil {
 		return fmt.Errorf("failed to parse tls key file: '%v'", err)
 	}
-	conf.tlsCAKey, err = x509.ParseECPrivateKey(caKey.Bytes)
+	key, err := decryptPEMKey(caKey, conf.tlsKeyPass)
 	if err != nil {
-		return fmt.Errorf("failed to parse tls cert file: '%v'", err)
+		return fmt.Errorf("failed to parse tls key file: '%v'", err)
+	}
+	var ok bool
+	conf.tlsCAKey, ok = key.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("tls key file does not hold an ecdsa key: %T", key)
+	}
+	caKeyDER, err := x509.MarshalECPrivateKey(conf.tlsCAKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode tls key: '%v'", err)
 	}
 
 	// Load CA cert for signing
@@ -149,5 +170,12 @@ func loadTLSCA(conf *config) error {
 		return fmt.Errorf("failed to parse tls cert file: '%v'", err)
 	}
 
+	// Build our server's TLS keypair from the decrypted key, since the key file may be encrypted
+	plainKeyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: caKeyDER})
+	conf.tlsCert, err = tls.X509KeyPair(caCertPem, plainKeyPem)
+	if err != nil {
+		return fmt.Errorf("failed to load tls keypair: '%v'", err)
+	}
+
 	return nil
 }
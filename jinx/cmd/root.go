@@ -58,6 +58,12 @@ func init() {
 
 	//RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.jinx.yaml)")
 	RootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose mode")
+	RootCmd.Flags().Bool("break-glass", false, "emergency request that skips the server's group checks (audited, short-lived)")
+	RootCmd.Flags().DurationP("duration", "d", 0, "requested certificate lifetime (e.g. 30m), limited by the server")
+	RootCmd.Flags().StringSliceP("extension", "e", nil, "requested certificate extension (e.g. permit-port-forwarding), may be repeated")
+	viper.BindPFlag("breakglass", RootCmd.Flags().Lookup("break-glass"))
+	viper.BindPFlag("duration", RootCmd.Flags().Lookup("duration"))
+	viper.BindPFlag("extensions", RootCmd.Flags().Lookup("extension"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -75,6 +81,7 @@ func initConfig() {
 		//fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
 
+	viper.SetDefault("approvalwait", 600) // 10 minute default
 	viper.SetDefault("autogenkeys", true)
 	viper.SetDefault("bastionip", "")
 	viper.SetDefault("insecure", false)
@@ -90,6 +97,7 @@ func initConfig() {
 	viper.SetDefault("sslkeyfile", "$HOME/.jinx/client.key")
 	viper.SetDefault("timeout", 30)
 	viper.SetDefault("urlauth", "https://localhost:444/auth/")
+	viper.SetDefault("urlchallenge", "https://localhost:444/challenge/")
 	viper.SetDefault("urlcurse", "https://localhost:444/")
 	viper.SetDefault("usesslca", true)
 }
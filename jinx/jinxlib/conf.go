@@ -5,6 +5,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -19,8 +20,12 @@ type config struct {
 	userPass    string
 	verbose     bool
 
+	ApprovalWait   int
 	AutoGenKeys    bool
 	BastionIP      string
+	BreakGlass     bool
+	Duration       time.Duration
+	Extensions     []string
 	Insecure       bool
 	KeyGenBitSize  int
 	KeyGenPubKey   string
@@ -34,6 +39,7 @@ type config struct {
 	SSLKeyFile     string
 	Timeout        int
 	URLAuth        string
+	URLChallenge   string
 	URLCurse       string
 	UseSSLCA       bool
 }
@@ -56,6 +62,9 @@ func getConf() (*config, error) {
 	if conf.PubKey == "" {
 		return nil, fmt.Errorf("pubkey is a required configuration field")
 	}
+	if conf.Duration < 0 {
+		return nil, fmt.Errorf("duration must not be negative: %v", conf.Duration)
+	}
 
 	// Replace $HOME with the current user's home directory
 	conf.PubKey = expandHome(conf.PubKey)
@@ -1,6 +1,7 @@
 package jinxlib
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -80,8 +81,7 @@ func Jinx(verbose bool, args []string) {
 				os.Exit(1)
 			}
 		default:
-			out := fmt.Sprintf("server response: %s", respBody)
-			fmt.Fprintf(os.Stderr, out)
+			fmt.Fprintf(os.Stderr, "server response: %s", respBody)
 			os.Exit(statusCode)
 		}
 	}
@@ -90,12 +90,17 @@ func Jinx(verbose bool, args []string) {
 	if conf.verbose {
 		fmt.Fprintln(os.Stderr, "making ssh cert request")
 	}
-	respBody, statusCode, err := requestSSHCert(conf, string(pubKey))
+	respBody, header, statusCode, err := requestSSHCert(conf, string(pubKey))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(statusCode)
 	}
 
+	// Let the user know if the server changed anything we asked for
+	for _, notice := range header["X-Curse-Notice"] {
+		fmt.Fprintf(os.Stderr, "notice: %s\n", notice)
+	}
+
 	switch statusCode {
 	case http.StatusOK:
 		err = ioutil.WriteFile(conf.certFile, respBody, 0644)
@@ -103,6 +108,17 @@ func Jinx(verbose bool, args []string) {
 			fmt.Fprintf(os.Stderr, "failed to write cert file: %v\n", err)
 			os.Exit(1)
 		}
+	case http.StatusAccepted:
+		cert, err := waitForApproval(conf, header.Get("Location"), respBody)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = ioutil.WriteFile(conf.certFile, cert, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write cert file: %v\n", err)
+			os.Exit(1)
+		}
 	case http.StatusUnprocessableEntity:
 		if conf.AutoGenKeys {
 			fmt.Fprintln(os.Stderr, "server denied pubkey due to age. regenerating keypairs. run command again after keys are regenerated.")
@@ -115,8 +131,22 @@ func Jinx(verbose bool, args []string) {
 			fmt.Fprintln(os.Stderr, "server denied pubkey due to age and automatic regeneration disabled. please manually regenerate your ssh keys.")
 			os.Exit(1)
 		}
+	case http.StatusServiceUnavailable:
+		fmt.Fprintln(os.Stderr, "certificate issuance has been locked down by your administrators. contact them for emergency access.")
+		os.Exit(statusCode)
+	case http.StatusTooManyRequests:
+		fmt.Fprintf(os.Stderr, "server is busy or rate limiting requests. try again in %s seconds.\n", header.Get("Retry-After"))
+		os.Exit(statusCode)
+	case http.StatusBadRequest:
+		fmt.Fprint(os.Stderr, string(respBody))
+		if bytes.Contains(respBody, []byte("security key required")) {
+			fmt.Fprintf(os.Stderr, "the server requires a hardware-backed security key (FIDO/U2F) for %s. generate one with 'ssh-keygen -t ed25519-sk', set pubkey in your jinx config to its .pub file and load it with ssh-add.\n", conf.SSHUser)
+		} else if bytes.HasPrefix(respBody, []byte("pubkey rejected")) {
+			fmt.Fprintf(os.Stderr, "the server does not accept this ssh key (%s). update keygentype/keygenbitsize or pubkey in your jinx config and regenerate your keys.\n", conf.pubKeyFile)
+		}
+		os.Exit(statusCode)
 	default:
-		fmt.Fprintf(os.Stderr, string(respBody))
+		fmt.Fprint(os.Stderr, string(respBody))
 		os.Exit(statusCode)
 	}
 }
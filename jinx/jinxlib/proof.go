@@ -0,0 +1,108 @@
+package jinxlib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/bgentry/speakeasy"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// challengePrefix must match the prefix cursed expects on signed nonces
+const challengePrefix = "curse-challenge-v1:"
+
+func signChallenge(conf *config, pubKey []byte, nonce string) (string, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(pubKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse pubkey: %v", err)
+	}
+
+	// Prefer the ssh-agent if it holds our key, otherwise fall back to the private key file
+	var signer ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			defer conn.Close()
+			signers, err := agent.NewClient(conn).Signers()
+			if err == nil {
+				for _, s := range signers {
+					if bytes.Equal(s.PublicKey().Marshal(), pk.Marshal()) {
+						signer = s
+						break
+					}
+				}
+			}
+		}
+	}
+	if signer == nil && strings.HasPrefix(pk.Type(), "sk-") {
+		return "", fmt.Errorf("security key %s must be loaded into ssh-agent to sign the key proof. run: ssh-add %s", conf.pubKeyFile, conf.privKeyFile)
+	}
+	if signer == nil {
+		signer, err = loadPrivateKey(conf)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), pk.Marshal()) {
+			return "", fmt.Errorf("private key %s does not match pubkey %s", conf.privKeyFile, conf.pubKeyFile)
+		}
+	}
+
+	// Use SHA-2 signatures for RSA keys where we can
+	data := []byte(challengePrefix + nonce)
+	var sig *ssh.Signature
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && pk.Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign key proof challenge: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(ssh.Marshal(sig)), nil
+}
+
+func loadPrivateKey(conf *config) (ssh.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(conf.privKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %v", err)
+	}
+
+	// Keys we generated ourselves may be bare ecdsa keys, which the ssh package doesn't recognize
+	block, _ := pem.Decode(keyBytes)
+	if block != nil && block.Type == "EC PARAMETERS" {
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ecdsa private key: %v", err)
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		pass, err := speakeasy.Ask(fmt.Sprintf("passphrase for %s: ", conf.privKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("shell error: %v", err)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(pass))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key: %v", err)
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	return signer, nil
+}
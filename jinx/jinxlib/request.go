@@ -8,29 +8,41 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"os/user"
 	"time"
 )
 
 type params struct {
-	BastionIP   string `json:"bastion_ip,omitempty"`
-	BastionUser string `json:"bastion_user,omitempty"`
-	Cmd         string `json:"cmd,omitempty"`
-	CSR         string `json:"csr,omitempty"`
-	Key         string `json:"key,omitempty"`
-	RemoteUser  string `json:"remote_user,omitempty"`
-	UserIP      string `json:"user_ip,omitempty"`
+	BastionIP   string   `json:"bastion_ip,omitempty"`
+	BastionUser string   `json:"bastion_user,omitempty"`
+	BreakGlass  bool     `json:"break_glass,omitempty"`
+	Cmd         string   `json:"cmd,omitempty"`
+	CSR         string   `json:"csr,omitempty"`
+	Duration    int      `json:"duration,omitempty"`
+	Extensions  []string `json:"extensions,omitempty"`
+	Key         string   `json:"key,omitempty"`
+	Nonce       string   `json:"nonce,omitempty"`
+	RemoteUser  string   `json:"remote_user,omitempty"`
+	Signature   string   `json:"signature,omitempty"`
+	UserIP      string   `json:"user_ip,omitempty"`
 }
 
-func requestSSHCert(conf *config, pubKey string) ([]byte, int, error) {
+type challengeResponse struct {
+	Expires time.Time `json:"expires"`
+	Nonce   string    `json:"nonce"`
+}
+
+func mutualTLSClient(conf *config) (*http.Client, error) {
 	// Prep our mutual auth cert/key and TLS settings
 	keyPair, err := tls.LoadX509KeyPair(conf.SSLCertFile, conf.SSLKeyFile)
 	if err != nil {
-		return nil, 1, fmt.Errorf("failed to load tls mutual auth client certfificate/key pair: %v", err)
+		return nil, fmt.Errorf("failed to load tls mutual auth client certfificate/key pair: %v", err)
 	}
 	ca, err := ioutil.ReadFile(conf.SSLCAFile)
 	if err != nil {
-		return nil, 1, fmt.Errorf("failed to load tls mutual auth ca: %v", err)
+		return nil, fmt.Errorf("failed to load tls mutual auth ca: %v", err)
 	}
 	certPool := x509.NewCertPool()
 	certPool.AppendCertsFromPEM(ca)
@@ -50,19 +62,146 @@ func requestSSHCert(conf *config, pubKey string) ([]byte, int, error) {
 		Timeout:   time.Duration(conf.Timeout) * time.Second,
 	}
 
+	return client, nil
+}
+
+func requestChallenge(client *http.Client, conf *config) (string, error) {
+	resp, err := client.Get(conf.URLChallenge)
+	if err != nil {
+		return "", fmt.Errorf("connection failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to process response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("challenge request failed: %s", respBody)
+	}
+
+	var c challengeResponse
+	err = json.Unmarshal(respBody, &c)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse challenge response: %v", err)
+	}
+
+	return c.Nonce, nil
+}
+
+type approvalResponse struct {
+	Approver  string    `json:"approver"`
+	Cert      string    `json:"cert"`
+	Expires   time.Time `json:"expires"`
+	ID        string    `json:"id"`
+	Principal string    `json:"principal"`
+	Reason    string    `json:"reason"`
+	Status    string    `json:"status"`
+}
+
+// How often to check on a request waiting for approval
+const approvalPollInterval = 5 * time.Second
+
+func waitForApproval(conf *config, location string, body []byte) ([]byte, error) {
+	var ar approvalResponse
+	err := json.Unmarshal(body, &ar)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse approval response: %v", err)
+	}
+
+	// Find our request's status URL relative to the server
+	base, err := url.Parse(conf.URLCurse)
+	if err != nil {
+		return nil, fmt.Errorf("invalid urlcurse: %v", err)
+	}
+	loc, err := url.Parse(location)
+	if err != nil || location == "" {
+		return nil, fmt.Errorf("server sent an invalid approval status location: %q", location)
+	}
+	statusURL := base.ResolveReference(loc).String()
+
+	client, err := mutualTLSClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	wait := time.Duration(conf.ApprovalWait) * time.Second
+	fmt.Fprintf(os.Stderr, "certificate request %s for %s requires approval. waiting up to %v...\n", ar.ID, ar.Principal, wait)
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		time.Sleep(approvalPollInterval)
+
+		resp, err := client.Get(statusURL)
+		if err != nil {
+			if conf.verbose {
+				fmt.Fprintf(os.Stderr, "approval status check failed: %v\n", err)
+			}
+			continue
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			if conf.verbose {
+				fmt.Fprintf(os.Stderr, "approval status check failed: %d %s\n", resp.StatusCode, respBody)
+			}
+			continue
+		}
+
+		ar = approvalResponse{}
+		err = json.Unmarshal(respBody, &ar)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse approval response: %v", err)
+		}
+		switch ar.Status {
+		case "approved":
+			fmt.Fprintf(os.Stderr, "request approved by %s\n", ar.Approver)
+			return []byte(ar.Cert), nil
+		case "denied":
+			return nil, fmt.Errorf("request denied by %s: %s", ar.Approver, ar.Reason)
+		case "expired":
+			return nil, fmt.Errorf("request expired at %s without a decision", ar.Expires.Local().Format(time.RFC1123))
+		}
+	}
+
+	return nil, fmt.Errorf("gave up waiting for approval of request %s", ar.ID)
+}
+
+func requestSSHCert(conf *config, pubKey string) ([]byte, http.Header, int, error) {
+	client, err := mutualTLSClient(conf)
+	if err != nil {
+		return nil, nil, 1, err
+	}
+
+	// Prove to the server that we hold the private key for our pubkey. Servers from before key proofs
+	// were added don't offer a challenge, so carry on without a proof and let the server decide
+	var sig string
+	nonce, proofErr := requestChallenge(client, conf)
+	if proofErr == nil {
+		sig, proofErr = signChallenge(conf, []byte(pubKey), nonce)
+	}
+	if proofErr != nil {
+		fmt.Fprintf(os.Stderr, "warning: sending request without key proof: %v\n", proofErr)
+		nonce, sig = "", ""
+	}
+
 	// Assemble our parameters
 	p := params{
 		BastionIP:  conf.BastionIP,
+		BreakGlass: conf.BreakGlass,
 		Cmd:        conf.cmd,
+		Duration:   int(conf.Duration / time.Second),
+		Extensions: conf.Extensions,
 		Key:        pubKey,
+		Nonce:      nonce,
 		RemoteUser: conf.SSHUser,
+		Signature:  sig,
 		UserIP:     conf.userIP,
 	}
 
 	// Assemble our json payload
 	pl, err := json.Marshal(p)
 	if err != nil {
-		return nil, 1, fmt.Errorf("failed to marshal json for request: %v", err)
+		return nil, nil, 1, fmt.Errorf("failed to marshal json for request: %v", err)
 	}
 
 	req, err := http.NewRequest("POST", conf.URLCurse, bytes.NewBuffer(pl))
@@ -70,16 +209,21 @@ func requestSSHCert(conf *config, pubKey string) ([]byte, int, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, 2, fmt.Errorf("connection failed: %v", err)
+		return nil, nil, 2, fmt.Errorf("connection failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, 2, fmt.Errorf("failed to process response: %v", err)
+		return nil, nil, 2, fmt.Errorf("failed to process response: %v", err)
 	}
 
-	return respBody, resp.StatusCode, nil
+	// The server wants a proof we couldn't give it
+	if proofErr != nil && resp.StatusCode == http.StatusForbidden && bytes.HasPrefix(respBody, []byte("key proof failed")) {
+		return nil, nil, 1, fmt.Errorf("server requires a key proof, which couldn't be made: %v", proofErr)
+	}
+
+	return respBody, resp.Header, resp.StatusCode, nil
 }
 
 func requestTLSCert(conf *config) ([]byte, int, error) {